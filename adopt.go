@@ -0,0 +1,82 @@
+package urknall
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/dynport/dgtk/confirm"
+)
+
+// Adopt marks the tasks matching the given patterns (all tasks if none are
+// given) as executed, without running any of their commands. This is used to
+// take over hosts that were set up by other means. The patterns are matched
+// against the task names using filepath.Match, e.g. "ruby.*".
+//
+// As the state written can't be told apart from actual executions, the build
+// must have a Confirm hook set, that is called with the actions before
+// anything is written.
+func (b *Build) Adopt(patterns ...string) error {
+	if b.Confirm == nil {
+		return fmt.Errorf("adopting requires the build's Confirm hook to be set")
+	}
+	for _, p := range patterns {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %s", p, err)
+		}
+	}
+	return b.withLock(func() error { return b.adopt(patterns) })
+}
+
+func (b *Build) adopt(patterns []string) error {
+	pkg, err := b.renderTemplate()
+	if err != nil {
+		return err
+	}
+	m, err := readState(b.Target)
+	if err != nil {
+		return err
+	}
+	b.result = &Result{}
+	actions := confirm.Actions{}
+
+	for _, t := range pkg.tasks {
+		if !matchesAny(t.name, patterns) {
+			continue
+		}
+		ex := []string{}
+		if s, ok := m[t.name]; ok {
+			ex = s.runSHAs
+		}
+		checksums := []string{}
+		adopted := false
+		for i, c := range t.commands {
+			cs := c.Checksum()
+			checksums = append(checksums, "/var/lib/urknall/"+t.name+"/"+cs+".done")
+			if !adopted && i < len(ex) && ex[i] == cs {
+				continue
+			}
+			adopted = true
+			if len(t.name) > b.maxLength {
+				b.maxLength = len(t.name)
+			}
+			runChecksums := append([]string{}, checksums...)
+			actions.Create(t.name+" "+c.LogMsg()+" (adopt)", nil, b.commandAction(t.name, runChecksums, c, "adopted"))
+		}
+		if adopted {
+			b.result.Adopted = append(b.result.Adopted, t.name)
+		}
+	}
+	return b.Confirm(actions...)
+}
+
+func matchesAny(name string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package urknall
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dynport/dgtk/confirm"
+)
+
+func callAll(actions ...*confirm.Action) error {
+	for _, a := range actions {
+		if err := a.Call(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestAdopt(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+
+	tpl := TemplateFunc(func(p Package) {
+		p.AddCommands("base", Shell("echo base"))
+		p.AddTemplate("swap", TemplateFunc(func(p Package) {
+			p.AddCommands("setup", Shell("mkswap /dev/sdb"), Shell("swapon /dev/sdb"))
+		}))
+	})
+
+	if err := (&Build{Target: ft, Template: tpl}).Adopt(); err == nil {
+		t.Errorf("expected adopting without confirmation to fail")
+	}
+	declined := &Build{Target: ft, Template: tpl, Confirm: func(actions ...*confirm.Action) error {
+		return fmt.Errorf("declined")
+	}}
+	if err := declined.Adopt("swap.*"); err == nil {
+		t.Errorf("expected declined adoption to fail")
+	}
+
+	b := &Build{Target: ft, Template: tpl, Confirm: callAll}
+	if err := b.Adopt("swap.*"); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := strings.Join(b.Result().Adopted, ","), "swap.setup"; v != ex {
+		t.Errorf("expected adopted tasks to be %q, got %q", ex, v)
+	}
+	if v := ft.Executed(); len(v) != 0 {
+		t.Errorf("expected nothing to be executed, got %q", v)
+	}
+
+	if err := Run(ft, tpl); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := strings.Join(ft.Executed(), ","), "echo base"; v != ex {
+		t.Errorf("expected executed commands to be %q, got %q", ex, v)
+	}
+}
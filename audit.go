@@ -0,0 +1,220 @@
+package urknall
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+
+	"github.com/dynport/urknall/target"
+	"github.com/dynport/urknall/utils"
+)
+
+// An entry of the audit log. Each entry contains the hash of its predecessor,
+// so that modifications of the log can be detected using VerifyAuditLog.
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Operator   string    `json:"operator"`
+	Host       string    `json:"host"`
+	User       string    `json:"user"`
+	Command    string    `json:"command"`
+	Checksum   string    `json:"checksum,omitempty"` // sha256 of the content of uploads
+	ExitStatus int       `json:"exit_status"`
+	Error      string    `json:"error,omitempty"`
+	Prev       string    `json:"prev"`
+	Hash       string    `json:"hash"`
+}
+
+func (e *AuditEntry) computeHash() (string, error) {
+	c := *e
+	c.Hash = ""
+	b, err := json.Marshal(&c)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b)), nil
+}
+
+// An AuditLog records all raw commands sent to targets (including the ones
+// urknall uses internally to manage its state) as JSON lines to an append
+// only file. Uploads are recorded as "upload <path>" with the checksum of the
+// content. The log must only be written by a single process at a time.
+type AuditLog struct {
+	Operator string // defaults to the current user
+
+	mutex sync.Mutex
+	file  *os.File
+	prev  string
+}
+
+// Open the audit log at the given path. The file is created if it doesn't
+// exist. An existing log is verified, as appending to a broken chain would
+// hide the modification.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	prev, _, err := verifyAuditLog(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to verify audit log %s: %s", path, err)
+	}
+	return &AuditLog{Operator: currentOperator(), file: f, prev: prev}, nil
+}
+
+func currentOperator() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// Wrap the given target so that all commands run on it are recorded.
+func (l *AuditLog) Target(t Target) Target {
+	return &auditTarget{Target: t, log: l}
+}
+
+func (l *AuditLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.file.Close()
+}
+
+func (l *AuditLog) write(t Target, cmd, checksum string, err error) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	e := &AuditEntry{
+		Time:     time.Now().UTC(),
+		Operator: l.Operator,
+		Host:     t.String(),
+		User:     t.User(),
+		Command:  cmd,
+		Checksum: checksum,
+		Prev:     l.prev,
+	}
+	if err != nil {
+		e.Error = err.Error()
+		if s, ok := exitStatus(err); ok {
+			e.ExitStatus = s
+		} else {
+			e.ExitStatus = -1
+		}
+	}
+	var hashErr error
+	if e.Hash, hashErr = e.computeHash(); hashErr != nil {
+		return hashErr
+	}
+	b, hashErr := json.Marshal(e)
+	if hashErr != nil {
+		return hashErr
+	}
+	if _, err := l.file.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %s", err)
+	}
+	l.prev = e.Hash
+	return nil
+}
+
+// Verify the hash chain of the audit log read from r. The number of valid
+// entries is returned.
+func VerifyAuditLog(r io.Reader) (int, error) {
+	_, cnt, err := verifyAuditLog(r)
+	return cnt, err
+}
+
+func verifyAuditLog(r io.Reader) (last string, cnt int, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		e := &AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			return last, cnt, fmt.Errorf("line %d: %s", cnt+1, err)
+		}
+		if e.Prev != last {
+			return last, cnt, fmt.Errorf("line %d: chain broken, expected previous hash %q, got %q", cnt+1, last, e.Prev)
+		}
+		h, err := e.computeHash()
+		if err != nil {
+			return last, cnt, err
+		}
+		if h != e.Hash {
+			return last, cnt, fmt.Errorf("line %d: hash mismatch, entry was modified", cnt+1)
+		}
+		last = e.Hash
+		cnt++
+	}
+	return last, cnt, scanner.Err()
+}
+
+type auditTarget struct {
+	Target
+	log *AuditLog
+}
+
+func (t *auditTarget) Command(cmd string) (target.ExecCommand, error) {
+	c, err := t.Target.Command(cmd)
+	if err != nil {
+		if lerr := t.log.write(t.Target, cmd, "", err); lerr != nil {
+			return nil, lerr
+		}
+		return nil, err
+	}
+	return withOptionalInterfaces(&auditCommand{ExecCommand: c, target: t, cmd: cmd}, c), nil
+}
+
+// Uploads are recorded explicitly, as uploaders run their commands on the
+// wrapped target.
+func (t *auditTarget) Upload(r io.Reader, path string, opts *target.UploadOptions) error {
+	u, ok := t.Target.(target.Uploader)
+	if !ok {
+		return errUploadsUnsupported
+	}
+	hash := sha256.New()
+	err := u.Upload(io.TeeReader(r, hash), path, opts)
+	if lerr := t.log.write(t.Target, "upload "+utils.ShellQuote(path), fmt.Sprintf("%x", hash.Sum(nil)), err); lerr != nil && err == nil {
+		return lerr
+	}
+	return err
+}
+
+// Wrapper writing the outcome of a command to the audit log. Failing to write
+// the log fails the command.
+type auditCommand struct {
+	target.ExecCommand
+	target *auditTarget
+	cmd    string
+	once   sync.Once
+}
+
+func (c *auditCommand) Run() error {
+	return c.record(c.ExecCommand.Run())
+}
+
+func (c *auditCommand) Start() error {
+	if err := c.ExecCommand.Start(); err != nil {
+		return c.record(err)
+	}
+	return nil
+}
+
+func (c *auditCommand) Wait() error {
+	return c.record(c.ExecCommand.Wait())
+}
+
+func (c *auditCommand) record(err error) error {
+	var lerr error
+	c.once.Do(func() {
+		lerr = c.target.log.write(c.target.Target, c.cmd, "", err)
+	})
+	if err == nil {
+		return lerr
+	}
+	return err
+}
@@ -0,0 +1,114 @@
+package urknall
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dynport/urknall/target"
+	"github.com/dynport/urknall/urknalltest"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "urknall-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	ft := newFakeTarget(t)
+	defer ft.Close()
+	ft.Handle("^echo 3$", &urknalltest.Response{ExitStatus: 2})
+
+	for i := 0; i < 2; i++ { // reopening the log must continue the chain
+		l, err := OpenAuditLog(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Operator = "alice"
+		if err := Run(l.Target(ft), TemplateFunc(threeCommands)); err == nil {
+			t.Fatalf("expected an error, got none")
+		}
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cnt, err := VerifyAuditLog(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := cnt, len(ft.Commands()); v != ex {
+		t.Errorf("expected %d entries, got %d", ex, v)
+	}
+	if !bytes.Contains(b, []byte(`"operator":"alice"`)) || !bytes.Contains(b, []byte(`"exit_status":2`)) {
+		t.Errorf("expected operator and exit status to be logged, got %s", b)
+	}
+
+	tampered := bytes.Replace(b, []byte(`"operator":"alice"`), []byte(`"operator":"mallory"`), 1)
+	if _, err := VerifyAuditLog(bytes.NewReader(tampered)); err == nil || !strings.Contains(err.Error(), "line 1: hash mismatch") {
+		t.Errorf("expected modification to be detected, got %v", err)
+	}
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	removed := bytes.Join(append(lines[:1:1], lines[2:]...), nil)
+	if _, err := VerifyAuditLog(bytes.NewReader(removed)); err == nil || !strings.Contains(err.Error(), "line 2: chain broken") {
+		t.Errorf("expected removed entry to be detected, got %v", err)
+	}
+	if err := ioutil.WriteFile(path, tampered, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenAuditLog(path); err == nil {
+		t.Errorf("expected opening a modified log to fail")
+	}
+}
+
+func TestAuditLogUploadsAndOptionalInterfaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "urknall-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := OpenAuditLog(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c, err := l.Target(&ptyTargetStub{}).Command("true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.(target.PtyRequester); !ok {
+		t.Errorf("expected audited command to support PTYs")
+	}
+
+	ft := newFakeTarget(t)
+	defer ft.Close()
+	u := &uploadTargetStub{Target: ft, uploads: map[string]string{}}
+	if err := l.Target(u).(target.Uploader).Upload(strings.NewReader("content"), "/etc/app.conf", nil); err != nil {
+		t.Fatal(err)
+	}
+	if v, ex := u.uploads["/etc/app.conf"], "content"; v != ex {
+		t.Errorf("expected uploaded content to be %q, was %q", ex, v)
+	}
+	if err := l.Target(ft).(target.Uploader).Upload(strings.NewReader("content"), "/etc/app.conf", nil); err != errUploadsUnsupported {
+		t.Errorf("expected uploads to targets without uploader to be unsupported, got %v", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := `"command":"upload '/etc/app.conf'","checksum":"ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"`
+	if !bytes.Contains(b, []byte(ex)) {
+		t.Errorf("expected upload to be logged as %s, got %s", ex, b)
+	}
+}
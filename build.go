@@ -6,12 +6,11 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"text/template"
@@ -19,8 +18,11 @@ import (
 
 	"github.com/dynport/dgtk/confirm"
 	"github.com/dynport/gocli"
+	"github.com/dynport/urknall/cmd"
 	"github.com/dynport/urknall/pubsub"
 	"github.com/dynport/urknall/target"
+
+	"github.com/dynport/urknall/utils"
 )
 
 // A shortcut creating and running a build from the given target and template.
@@ -46,13 +48,76 @@ type Build struct {
 	Template          // What to actually build.
 	Env      []string // Environment variables in the form `KEY=VALUE`.
 	Confirm  func(actions ...*confirm.Action) error
+	FetchDir string // Local directory fetched files are stored in ("fetched" if empty).
+
+	// Orphaned tasks (found on the host, but no longer rendered by the
+	// template) are always reported. If Prune is set their teardown commands
+	// are run and their state is removed. This must only be used if the
+	// template is the only one built on the host.
+	Prune bool
+
+	Retention *Retention // Applied to the build history on the host after a successful run.
+
+	// Builds lock the host, so that concurrent builds fail with a
+	// LockedError. Locks older than LockTimeout (6 hours if zero) are
+	// considered stale and taken over. ForceUnlock takes over any lock.
+	LockTimeout time.Duration
+	ForceUnlock bool
+
+	maxLength int     // length of the longest key to be executed
+	result    *Result // result of the last run
+	facts     *Facts  // facts of the target, gathered once per build
+}
+
+// The result of a build.
+type Result struct {
+	Fetched    []*FetchedFile // Files fetched from the host.
+	Guards     []*GuardResult // Guards evaluated during the build.
+	Orphans    []string       // Tasks found on the host, but no longer rendered.
+	Migrations []*Migration   // Renamed tasks, whose state was moved.
+	Adopted    []string       // Tasks marked as executed without running their commands.
+	Removed    []string       // Entries of the build history removed by the retention policy.
+}
 
-	maxLength int // length of the longest key to be executed
+// Returns the result of the last run of the build (nil if it wasn't run).
+func (b *Build) Result() *Result {
+	return b.result
+}
+
+// Returns the facts of the build's target. They are gathered on first use and
+// cached afterwards.
+func (b *Build) Facts() (*Facts, error) {
+	if b.facts == nil {
+		f, err := gatherFacts(b.Target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to gather facts: %s", err)
+		}
+		b.facts = f
+	}
+	return b.facts, nil
+}
+
+func (b *Build) renderTemplate() (*packageImpl, error) {
+	f, err := b.Facts()
+	if err != nil {
+		return nil, err
+	}
+	return renderTemplateWithFacts(b.Template, f)
 }
 
 // This will render the build's template into a package and run all its tasks.
+// The host is locked for the duration of the build.
+//
+// Templates that are pointers to structs are rendered as a copy, so that a
+// template can be shared by several builds. Hence the build's template isn't
+// modified, i.e. values set by validation (`urknall:"default=..."`) or host
+// facts are only visible while rendering.
 func (b *Build) Run() error {
-	i, err := renderTemplate(b.Template)
+	return b.withLock(b.run)
+}
+
+func (b *Build) run() error {
+	i, err := b.renderTemplate()
 	if err != nil {
 		return err
 	}
@@ -60,35 +125,40 @@ func (b *Build) Run() error {
 	if err != nil {
 		return err
 	}
+	b.result = &Result{}
 	actions := confirm.Actions{}
 
-	for _, t := range i.tasks {
-		ex := []string{}
-		if s, ok := m[t.name]; ok {
-			ex = s.runSHAs
+	b.result.Migrations = migrateState(i, m)
+	for _, mig := range b.result.Migrations {
+		actions.Create(mig.From+" -> "+mig.To+" (migrate state)", nil, b.migrationAction(mig))
+	}
+
+	planned, err := b.plan(i, m)
+	if err != nil {
+		return err
+	}
+	for _, p := range planned {
+		name := p.task.name + " " + p.command.LogMsg()
+		if p.note != "" {
+			name += " (" + p.note + ")"
 		}
 
-		diff := []string{}
-		checksums := []string{}
-		broken := false
-		for i, c := range t.commands {
-			cs := c.Checksum()
-			checksums = append(checksums, "/var/lib/urknall/"+t.name+"/"+cs+".done")
-			if broken || len(ex) <= i || ex[i] != cs {
-				diff = append(diff, cs)
-				broken = true
-
-				var pl []byte
-				_, cmd, ok, err := extractWriteFile(c.command.Shell())
-				if err == nil && ok {
-					pl = []byte(cmd)
-				}
-				if len(t.name) > b.maxLength {
-					b.maxLength = len(t.name)
-				}
-				actions.Create(t.name+" "+c.LogMsg(), pl, b.commandAction(t.name, checksums, c))
-			}
+		var pl []byte
+		_, cmd, ok, err := extractWriteFile(p.command.command.Shell())
+		if err == nil && ok {
+			pl = []byte(cmd)
 		}
+		if len(p.task.name) > b.maxLength {
+			b.maxLength = len(p.task.name)
+		}
+		skipReason := ""
+		if p.skip {
+			skipReason = skipGuardFailed
+		}
+		actions.Create(name, pl, b.commandAction(p.task.name, p.checksums, p.command, skipReason))
+	}
+	if err := b.teardownActions(i, m, &actions); err != nil {
+		return err
 	}
 
 	if b.Confirm != nil {
@@ -102,249 +172,145 @@ func (b *Build) Run() error {
 			}
 		}
 	}
-	return nil
-}
-
-func (b *Build) DryRun() error {
-	pkg, e := b.prepareBuild()
-	if e != nil {
-		return e
-	}
-
-	for _, task := range pkg.tasks {
-		for _, command := range task.commands {
-			m := message(pubsub.MessageTasksProvisionTask, b.hostname(), task.name)
-			m.TaskChecksum = command.Checksum()
-			m.Message = command.LogMsg()
-
-			switch {
-			case command.cached:
-				m.ExecStatus = pubsub.StatusCached
-				m.Publish("finished")
-			default:
-				m.ExecStatus = pubsub.StatusExecStart
-				m.Publish("executed")
-			}
-		}
+	if err := b.fetchFiles(i.tasks); err != nil {
+		return err
 	}
-	return nil
+	b.result.Removed, err = b.gc(b.Retention)
+	return err
 }
 
-func (build *Build) prepareBuild() (*packageImpl, error) {
-	pkg, e := renderTemplate(build.Template)
-	if e != nil {
-		return nil, e
-	}
-
-	if e = build.prepareTarget(); e != nil {
-		return nil, e
-	}
-
-	ct, e := build.buildChecksumTree()
-	if e != nil {
-		return nil, fmt.Errorf("error building checksum tree: %s", e.Error())
-	}
-
-	return pkg, build.prepareTasks(ct, pkg.tasks...)
+// A command that is part of the build.
+type plannedCommand struct {
+	task      *task
+	command   *commandWrapper
+	checksums []string // done files listed in the task's run file once executed
+	note      string   // shown in the plan
+	skip      bool     // the command's shell code is skipped (guard failed)
 }
 
-func (build *Build) prepareTarget() error {
-	if build.User() == "" {
-		return fmt.Errorf("User not set")
-	}
-	rawCmd := fmt.Sprintf(`{ grep "^%s:" /etc/group | grep %s; } && [ -d %[3]s ] && [ -f %[3]s/.v2 ]`,
-		ukGROUP, build.User(), ukCACHEDIR)
-	cmd, e := build.prepareInternalCommand(rawCmd)
-	if e != nil {
-		return e
-	}
-	if e := cmd.Run(); e != nil {
-		// If user is missing the group, create group (if necessary), add user and restart ssh connection.
-		cmds := []string{
-			fmt.Sprintf(`{ grep -e '^%[1]s:' /etc/group > /dev/null || { groupadd %[1]s; }; }`, ukGROUP),
-			fmt.Sprintf(`{ [ -d %[1]s ] || { mkdir -p -m 2775 %[1]s && chgrp %[2]s %[1]s; }; }`, ukCACHEDIR, ukGROUP),
-			fmt.Sprintf("usermod -a -G %s %s", ukGROUP, build.User()),
-			fmt.Sprintf(`[ -f %[1]s/.v2 ] || { export DATE=$(date "+%%Y%%m%%d_%%H%%M%%S") && ls %[1]s | while read dir; do ls -t %[1]s/$dir/*.done | tac > %[1]s/$dir/$DATE.run; done && touch %[1]s/.v2;  } `, ukCACHEDIR),
+// Decide which commands of the package are part of the build, given the
+// host's state (see planCommand). Guards are evaluated and added to the
+// build's result.
+func (b *Build) plan(pkg *packageImpl, m map[string]*taskState) ([]*plannedCommand, error) {
+	planned := []*plannedCommand{}
+	for _, t := range pkg.tasks {
+		ex := []string{}
+		if s, ok := m[t.name]; ok {
+			ex = s.runSHAs
 		}
 
-		cmd, e = build.prepareInternalCommand(strings.Join(cmds, " && "))
-		if e != nil {
-			return e
-		}
-		out := &bytes.Buffer{}
-		err := &bytes.Buffer{}
-		cmd.SetStderr(err)
-		cmd.SetStdout(out)
-		if e := cmd.Run(); e != nil {
-			return fmt.Errorf("failed to initiate user %q for provisioning: %s, out=%q err=%q", build.User(), e, out.String(), err.String())
+		// number of leading commands that were executed already
+		matched := 0
+		for matched < len(ex) && matched < len(t.commands) && ex[matched] == t.commands[matched].Checksum() {
+			matched++
 		}
-		return build.Reset()
-	}
-	return nil
-}
 
-func (build *Build) prepareTasks(ct checksumTree, tasks ...*task) error {
-	for _, task := range tasks {
-		if err := build.prepareTask(task, ct); err != nil {
-			return err
+		checksums := []string{}
+		for i, c := range t.commands {
+			cs := c.Checksum()
+			checksums = append(checksums, "/var/lib/urknall/"+t.name+"/"+cs+".done")
+			guard, err := b.evalGuard(t.name, c)
+			if err != nil {
+				return nil, err
+			}
+			if guard != nil {
+				b.result.Guards = append(b.result.Guards, guard)
+			}
+
+			var doneAt time.Time
+			var drift []string
+			if s, ok := m[t.name]; ok {
+				doneAt = s.doneAt[cs]
+				drift = s.drift(cs)
+			}
+			execute, skip, note := planCommand(c.command, i < matched, doneAt, drift, guard)
+			if !execute {
+				continue
+			}
+			p := &plannedCommand{task: t, command: c, note: note, skip: skip}
+			if i < matched {
+				// Rerunning a cached command must not invalidate the
+				// subsequent ones, i.e. the run file lists all executed.
+				p.checksums = make([]string, matched)
+				for j := range p.checksums {
+					p.checksums[j] = "/var/lib/urknall/" + t.name + "/" + t.commands[j].Checksum() + ".done"
+				}
+			} else {
+				p.checksums = append([]string{}, checksums...)
+			}
+			planned = append(planned, p)
 		}
 	}
-	return nil
+	return planned, nil
 }
 
-func (build *Build) prepareTask(tsk *task, ct checksumTree) (e error) {
-	cacheKey := tsk.name
-	if cacheKey == "" {
-		return fmt.Errorf("CacheKey must not be empty")
+// Publish the plan of the build without executing it. The plan is made like
+// for Run, i.e. guards are evaluated and the host's state is considered
+// (including cache expiry and drift of tracked paths). Like for Run, a copy of
+// the build's template is rendered.
+func (b *Build) DryRun() error {
+	pkg, err := b.renderTemplate()
+	if err != nil {
+		return err
 	}
-	checksumDir := fmt.Sprintf(ukCACHEDIR+"/%s", tsk.name)
-
-	var found bool
-	var checksumList []string
-
-	if checksumList, found = ct[cacheKey]; !found {
-		// Create checksum dir and set group bit (all new files will inherit the directory's group). This allows for
-		// different users (being part of that group) to create, modify and delete the contained checksum and log files.
-		createChecksumDirCmd := fmt.Sprintf("mkdir -m2775 -p %s", checksumDir)
-
-		cmd, e := build.prepareInternalCommand(createChecksumDirCmd)
-		if e != nil {
-			return e
-		}
-		err := &bytes.Buffer{}
-
-		cmd.SetStderr(err)
-
-		if e := cmd.Run(); e != nil {
-			return fmt.Errorf(err.String() + ": " + e.Error())
-		}
+	m, err := readState(b.Target)
+	if err != nil {
+		return err
 	}
-
-	// find commands that need not be executed
-	for i, cmd := range tsk.commands {
-		checksum, e := commandChecksum(cmd.command)
-		if e != nil {
-			return e
-		}
-
-		switch {
-		case len(checksumList) <= i || checksum != checksumList[i]:
-			return nil
-		default:
-			cmd.cached = true
-		}
+	b.result = &Result{}
+	b.result.Migrations = migrateState(pkg, m)
+	planned, err := b.plan(pkg, m)
+	if err != nil {
+		return err
+	}
+	byCommand := map[*commandWrapper]*plannedCommand{}
+	for _, p := range planned {
+		byCommand[p.command] = p
 	}
 
-	return nil
-}
-
-func (build *Build) buildTask(tsk *task) (e error) {
-	checksumDir := fmt.Sprintf(ukCACHEDIR+"/%s", tsk.name)
-
-	tsk.started = time.Now()
-
-	for _, cmd := range tsk.commands {
-		checksum := cmd.Checksum()
-
-		m := message(pubsub.MessageTasksProvisionTask, build.hostname(), tsk.name)
-		m.TaskChecksum = checksum
-		m.Message = cmd.LogMsg()
-
-		var cmdErr error
+	for _, task := range pkg.tasks {
+		for _, command := range task.commands {
+			m := message(pubsub.MessageTasksProvisionTask, b.hostname(), task.name)
+			m.TaskChecksum = command.Checksum()
+			m.Message = command.LogMsg()
 
-		switch {
-		case cmd.cached:
-			m.ExecStatus = pubsub.StatusCached
-		default:
-			m.ExecStatus = pubsub.StatusExecStart
-			m.Publish("started")
-
-			r := &commandRunner{
-				build:    build,
-				command:  cmd.command,
-				dir:      checksumDir,
-				taskName: tsk.name,
+			p, ok := byCommand[command]
+			switch {
+			case !ok:
+				m.ExecStatus = pubsub.StatusCached
+				m.Publish("finished")
+			default:
+				if p.note != "" {
+					m.Message += " (" + p.note + ")"
+				}
+				m.ExecStatus = pubsub.StatusExecStart
+				m.Publish("executed")
 			}
-			cmdErr = r.run()
-
-			m.Error = cmdErr
-			m.ExecStatus = pubsub.StatusExecFinished
-		}
-		m.Publish("finished")
-		err := build.addCmdToTaskLog(tsk, checksumDir, checksum, cmdErr)
-		switch {
-		case cmdErr != nil:
-			return cmdErr
-		case err != nil:
-			return err
 		}
 	}
-
 	return nil
 }
 
-// addCmdToTaskLog will manage the log of run commands in a file. This file gets append the path to a file
-// for each command, that contains the executed script. The filename contains either ".done" or ".failed" as
-// suffix, depending on the err given (nil or not).
-func (build *Build) addCmdToTaskLog(tsk *task, checksumDir, checksum string, err error) (e error) {
-	prefix := checksumDir + "/" + checksum
-	sourceFile := prefix + ".sh"
-	targetFile := prefix + ".done"
-	if err != nil {
-		logError(err)
-		targetFile = prefix + ".failed"
-	}
-	rawCmd := fmt.Sprintf("{ [ -f %[1]s ] || mv %[2]s %[1]s; } && echo %[1]s >> %[3]s/%[4]s.run",
-		targetFile, sourceFile, checksumDir, tsk.started.Format("20060102_150405"))
-	c, e := build.prepareInternalCommand(rawCmd)
-	if e != nil {
-		return e
-	}
-
-	return c.Run()
-}
+// Creates the group owning the state directory and the directory itself (if
+// missing).
+var prepareStateDirCmd = fmt.Sprintf(`{ grep -e '^%[1]s:' /etc/group > /dev/null || { groupadd %[1]s; }; } && { [ -d %[2]s ] || { mkdir -p -m 2775 %[2]s && chgrp %[1]s %[2]s; }; }`, ukGROUP, ukCACHEDIR)
 
-type checksumTree map[string][]string
-
-func (build *Build) buildChecksumTree() (ct checksumTree, e error) {
-	ct = checksumTree{}
-
-	rawCmd := fmt.Sprintf(
-		`[ -d %[1]s ] && { ls %[1]s | while read dir; do ls -t %[1]s/$dir/*.run | head -n1 | xargs cat; done; }`,
-		ukCACHEDIR)
-	cmd, e := build.prepareInternalCommand(rawCmd)
-	if e != nil {
-		return nil, e
-	}
-	out := &bytes.Buffer{}
-	err := &bytes.Buffer{}
-
-	cmd.SetStdout(out)
-	cmd.SetStderr(err)
-
-	if e := cmd.Run(); e != nil {
-		return nil, fmt.Errorf("%s: out=%s err=%s", e.Error(), out.String(), err.String())
+// Internal commands get a PTY if the target allocates one for all commands
+// (e.g. for hosts with sudo's requiretty option set).
+func (build *Build) prepareCommand(rawCmd string) (target.ExecCommand, error) {
+	c, err := build.prepareCommandWithStdin(rawCmd)
+	if err != nil {
+		return nil, err
 	}
-
-	for _, line := range strings.Split(out.String(), "\n") {
-		line = strings.TrimSpace(line)
-
-		if line == "" || !strings.HasSuffix(line, ".done") {
-			continue
-		}
-
-		pkgname := filepath.Dir(strings.TrimPrefix(line, ukCACHEDIR+"/"))
-		checksum := strings.TrimSuffix(filepath.Base(line), ".done")
-		if len(checksum) != 64 {
-			return nil, fmt.Errorf("invalid checksum %q found for package %q", checksum, pkgname)
-		}
-		ct[pkgname] = append(ct[pkgname], checksum)
+	if err := requestTargetPty(c); err != nil {
+		return nil, err
 	}
-
-	return ct, nil
+	return c, nil
 }
 
-func (build *Build) prepareCommand(rawCmd string) (target.ExecCommand, error) {
+// Like prepareCommand, but without a PTY, so that the command's stdin is
+// passed unaltered and closing it signals EOF.
+func (build *Build) prepareCommandWithStdin(rawCmd string) (target.ExecCommand, error) {
 	var sudo string
 	if build.User() != "root" {
 		sudo = "sudo "
@@ -364,16 +330,55 @@ func (build *Build) hostname() string {
 	return "MISSING"
 }
 
-func (b *Build) commandAction(name string, checksums []string, c *commandWrapper) func() error {
+// Skip reason of commands whose guard failed. These are marked as skipped in
+// the build's state, so checks don't probe them.
+const skipGuardFailed = "guard failed"
+
+// Returns the action executing the given command. If a skip reason is given
+// the command's state is written, but the command itself is not executed.
+func (b *Build) commandAction(name string, checksums []string, c *commandWrapper, skipReason string) func() error {
 	return func() error {
+		prefix := b.logPrefix(name)
+		skip := skipReason != ""
+		if skip {
+			fmt.Println(prefix + " " + c.LogMsg() + " (skipped, " + skipReason + ")")
+		} else {
+			fmt.Println(prefix + " " + c.LogMsg())
+		}
+
+		command := unwrapCommand(c.command)
+		shell := c.command.Shell()
+		shipped := false
+		if !skip {
+			path, err := b.shipFile(command)
+			if err != nil {
+				return err
+			}
+			if shipped = path != ""; shipped {
+				// the shell code contains the file's content, that must not
+				// be sent with the command
+				shell = fmt.Sprintf("# uploaded %q", path)
+			}
+		}
+		tracked := []string{}
+		if pt, ok := command.(cmd.PathTracker); ok {
+			for _, p := range pt.TrackedPaths() {
+				tracked = append(tracked, utils.ShellQuote(p))
+			}
+		}
 		s := struct {
 			Command, Checksum, Name string
 			ChecksumFiles           string
+			TrackedPaths            string
+			Skip, GuardFailed       bool
 		}{
-			Command:       c.command.Shell(),
+			Command:       shell,
 			Checksum:      c.Checksum(),
 			Name:          name,
 			ChecksumFiles: strings.Join(checksums, "\n"),
+			TrackedPaths:  strings.Join(tracked, " "),
+			Skip:          shipped || skip,
+			GuardFailed:   skipReason == skipGuardFailed,
 		}
 		cm, err := render(cmdTpl, s)
 		if err != nil {
@@ -385,6 +390,14 @@ func (b *Build) commandAction(name string, checksums []string, c *commandWrapper
 		if err != nil {
 			return err
 		}
+		if err := configureExecCommand(command, ec); err != nil {
+			return err
+		}
+		if sc, ok := command.(cmd.StdinConsumer); ok && !shipped && !skip {
+			in := sc.Input()
+			defer in.Close()
+			ec.SetStdin(in)
+		}
 		o, err := ec.StdoutPipe()
 		if err != nil {
 			return err
@@ -394,17 +407,8 @@ func (b *Build) commandAction(name string, checksums []string, c *commandWrapper
 			return err
 		}
 		wg.Add(2)
-		l := b.maxLength
-		if l > maxKeyLogLength {
-			l = maxKeyLogLength
-		}
-		if len(name) > l {
-			name = midTrunc(name, maxKeyLogLength)
-		}
-		prefix := fmt.Sprintf("%s [%-*s]", b.Target.String(), l, name)
 		go consumeStream(prefix, gocli.Red, e, wg)
 		go consumeStream(prefix, func(in string) string { return in }, o, wg)
-		fmt.Println(prefix + " " + c.LogMsg())
 		if err := ec.Start(); err != nil {
 			return err
 		}
@@ -412,16 +416,96 @@ func (b *Build) commandAction(name string, checksums []string, c *commandWrapper
 	}
 }
 
+// Prefix of log lines of the task with the given name.
+func (b *Build) logPrefix(name string) string {
+	l := b.maxLength
+	if l > maxKeyLogLength {
+		l = maxKeyLogLength
+	}
+	label := name
+	if len(label) > l {
+		label = midTrunc(label, maxKeyLogLength)
+	}
+	return fmt.Sprintf("%s [%-*s]", b.Target.String(), l, label)
+}
+
+// Returned by uploaders wrapping targets that can't upload files. The commands
+// send their files themselves then.
+var errUploadsUnsupported = fmt.Errorf("uploads not supported by target")
+
+// Commands implementing cmd.FileShipper are transferred using the target's
+// Uploader (if available). Returns the path of the file shipped that way
+// (empty if it wasn't).
+func (b *Build) shipFile(c cmd.Command) (string, error) {
+	fs, ok := c.(cmd.FileShipper)
+	if !ok {
+		return "", nil
+	}
+	u, ok := b.Target.(target.Uploader)
+	if !ok {
+		return "", nil
+	}
+	f, err := fs.ShipFile()
+	if err != nil {
+		return "", err
+	}
+	defer f.Content.Close()
+	opts := &target.UploadOptions{Mode: f.Mode, Owner: f.Owner, Group: f.Group}
+	if err := u.Upload(f.Content, f.Path, opts); err == errUploadsUnsupported {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to upload %q: %s", f.Path, err)
+	}
+	return f.Path, nil
+}
+
+// Set up the session of the given exec command according to the optional
+// interfaces implemented by the command. Commands consuming stdin don't get
+// the target's PTY, unless they require a terminal.
+func configureExecCommand(c cmd.Command, ec target.ExecCommand) error {
+	if af, ok := c.(cmd.AgentForwarding); ok && af.ForwardAgent() {
+		f, ok := ec.(target.AgentForwarder)
+		if !ok {
+			return fmt.Errorf("agent forwarding requested, but not supported by target")
+		}
+		if err := f.ForwardAgent(); err != nil {
+			return err
+		}
+	}
+
+	pr, ok := ec.(target.PtyRequester)
+	if tr, isTR := c.(cmd.TerminalRequirer); isTR && tr.RequiresTerminal() {
+		if !ok {
+			return fmt.Errorf("terminal required, but not supported by target")
+		}
+		return pr.RequestPty()
+	}
+	if _, isSC := c.(cmd.StdinConsumer); isSC {
+		return nil
+	}
+	return requestTargetPty(ec)
+}
+
+// Request a PTY for the given exec command, if the target is configured to
+// allocate one for all commands.
+func requestTargetPty(ec target.ExecCommand) error {
+	if pr, ok := ec.(target.PtyRequester); ok && pr.PtyEnabled() {
+		return pr.RequestPty()
+	}
+	return nil
+}
+
 func consumeStream(prefix string, form func(string) string, in io.Reader, wg *sync.WaitGroup) error {
 	defer wg.Done()
 	scanner := bufio.NewScanner(in)
 
 	for scanner.Scan() {
-		fields := strings.Split(scanner.Text(), "\t")
+		line := strings.TrimSuffix(scanner.Text(), "\r") // PTYs terminate lines with CRLF
+		fields := strings.Split(line, "\t")
 		if len(fields) > 2 {
 			fmt.Printf("%s %s\n", prefix, form(strings.Join(fields[2:], "\t")))
 		} else {
-			fmt.Printf("%s %s\n", prefix, form(scanner.Text()))
+			fmt.Printf("%s %s\n", prefix, form(line))
 		}
 	}
 	return scanner.Err()
@@ -447,6 +531,9 @@ function iso8601 {
 sudo_prefix=""
 if [[ $(id -u) != 0 ]]; then
   sudo_prefix="sudo"
+  if [[ -n $SSH_AUTH_SOCK ]]; then
+    sudo_prefix="sudo SSH_AUTH_SOCK=$SSH_AUTH_SOCK"
+  fi
 fi
 
 build_date=$(TZ=utc date +"%Y%m%d_%H%M%S")
@@ -463,45 +550,130 @@ run_path=$dir/$build_date.run
 log_path=$dir/{{ .Checksum }}.log
 uk_path=/var/lib/urknall/{{ .Name }}
 
+{{ if .Skip }}
+$sudo_prefix touch $log_path
+{{ if .GuardFailed }}$sudo_prefix touch $dir/{{ .Checksum }}.skipped{{ end }}
+{{ else }}
 $sudo_prefix bash $dir/{{ .Checksum }}.sh 2> >(while read line; do echo "$(iso8601)	stderr	$line"; done | $sudo_prefix tee -a $log_path) > >(while read line; do echo "$(iso8601)	stdout	$line"; done | $sudo_prefix tee -a $log_path)
-
+{{ end }}
+{{ if .TrackedPaths }}
+for path in {{ .TrackedPaths }}; do
+  if $sudo_prefix test -f "$path"; then
+    $sudo_prefix sha256sum "$path"
+  else
+    echo "missing  $path"
+  fi
+done | $sudo_prefix tee $dir/{{ .Checksum }}.sha256 > /dev/null
+{{ end }}
 $sudo_prefix mv $dir/{{ .Checksum }}.sh $dir/{{ .Checksum }}.done
 $sudo_prefix tee $run_path > /dev/null <<EOF
 {{ .ChecksumFiles }}
 EOF
 
 $sudo_prefix mkdir -p $uk_path
-$sudo_prefix cp $done_path $run_path $log_path $uk_path/
+$sudo_prefix cp $done_path $run_path $log_path {{ if .TrackedPaths }}$dir/{{ .Checksum }}.sha256 {{ end }}{{ if .GuardFailed }}$dir/{{ .Checksum }}.skipped {{ end }}$uk_path/
+{{ if not .GuardFailed }}$sudo_prefix rm -f $uk_path/{{ .Checksum }}.skipped{{ end }}
 `
 
 type taskState struct {
-	name    string
-	runSHAs []string
-	content map[string]string
+	name     string
+	runSHAs  []string
+	content  map[string]string
+	doneAt   map[string]time.Time // time of the last execution per checksum
+	sums     map[string]string    // hashes of tracked paths after the last execution per checksum
+	current  map[string]string    // current hashes of tracked paths per checksum
+	skipped  map[string]bool      // checksums of the commands skipped by their guard
+	teardown *string              // teardown script stored on the host (nil if there is none)
+}
+
+// Returns the tracked paths of the command with the given checksum, that were
+// modified since the command was executed.
+func (s *taskState) drift(checksum string) []string {
+	recorded, ok := s.sums[checksum]
+	if !ok {
+		return nil
+	}
+	current, ok := s.current[checksum]
+	if !ok {
+		return nil
+	}
+	parse := func(in string) map[string]string {
+		m := map[string]string{}
+		for _, l := range strings.Split(strings.TrimSpace(in), "\n") {
+			if f := strings.SplitN(l, "  ", 2); len(f) == 2 {
+				m[f[1]] = f[0]
+			}
+		}
+		return m
+	}
+	paths := []string{}
+	cm := parse(current)
+	for p, sum := range parse(recorded) {
+		if cm[p] != sum {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths
 }
 
 const stateCmd = `
 bash <<"EOF"
 set -e
 
-if [[ $(whoami) == "root" ]]; then
-  mkdir -p /var/lib/urknall
-else
-  sudo mkdir -p /var/lib/urknall
+sudo_prefix=""
+if [[ $(whoami) != "root" ]]; then
+  sudo_prefix="sudo"
+fi
+if [[ ! -d /var/lib/urknall ]]; then
+  exit
 fi
-files=$(find /var/lib/urknall -maxdepth 1 -mindepth 1 -type d)
+# paths in the archive are relative to the state directory
+cd /var/lib/urknall
+files=$(find . -maxdepth 1 -mindepth 1 -type d)
 
 if [[ -z $files ]]; then
   exit
 fi
 
-tar cvz $(
+# current hashes of the paths tracked by the executed commands
+current=$(mktemp -d)
+trap "rm -rf $current" EXIT
+
+paths=$(
 	for dir in $files; do
-		last_run=$(ls -t $dir/*.run | head -n1)
+		if [[ -f $dir/teardown.sh ]]; then
+			echo $dir/teardown.sh
+		fi
+		last_run=$(ls -t $dir/*.run 2> /dev/null | head -n1)
+		if [[ -z $last_run ]]; then
+			continue
+		fi
 		echo $last_run
-		cat $last_run
+		for done_file in $(cat $last_run); do
+			done_file=${done_file#/var/lib/urknall/}
+			echo $done_file
+			if [[ -f ${done_file%.done}.skipped ]]; then
+				echo ${done_file%.done}.skipped
+			fi
+			sums=${done_file%.done}.sha256
+			if [[ -f $sums ]]; then
+				echo $sums
+				mkdir -p $current/$(basename $dir)
+				while read -r sum path; do
+					if $sudo_prefix test -f "$path"; then
+						$sudo_prefix sha256sum "$path"
+					else
+						echo "missing  $path"
+					fi
+				done < $sums > $current/$(basename $dir)/$(basename ${done_file%.done}).current
+			fi
+		done
 	done
 )
+current_files=$(cd $current && find . -type f)
+
+tar cz $paths ${current_files:+-C $current $current_files}
 EOF
 `
 
@@ -524,13 +696,6 @@ func readState(target Target) (content map[string]*taskState, err error) {
 	return readItemsFromTar(t)
 }
 
-func inspect(in interface{}) {
-	b, err := json.MarshalIndent(in, "", "  ")
-	if err == nil {
-		os.Stdout.Write(b)
-	}
-}
-
 func readItemsFromTar(t *tar.Reader) (m map[string]*taskState, err error) {
 	m = map[string]*taskState{}
 	for {
@@ -544,15 +709,31 @@ func readItemsFromTar(t *tar.Reader) (m map[string]*taskState, err error) {
 				return nil, err
 			}
 			if _, ok := m[name]; !ok {
-				m[name] = &taskState{content: map[string]string{}}
+				m[name] = &taskState{
+					content: map[string]string{},
+					doneAt:  map[string]time.Time{},
+					sums:    map[string]string{},
+					current: map[string]string{},
+					skipped: map[string]bool{},
+				}
 			}
 			switch n := h.Name; {
+			case filepath.Base(n) == "teardown.sh":
+				s := string(b)
+				m[name].teardown = &s
 			case strings.HasSuffix(n, ".run"):
 				for _, f := range strings.Split(strings.TrimSpace(string(b)), "\n") {
 					m[name].runSHAs = append(m[name].runSHAs, doneFileToChecksum(f))
 				}
 			case strings.HasSuffix(n, ".done"):
+				m[name].doneAt[doneFileToChecksum(n)] = h.ModTime
 				m[name].content[doneFileToChecksum(n)] = strings.TrimSuffix(strings.TrimPrefix(string(b), "#!/bin/sh\nset -e\nset -x\n\n\n"), "\n")
+			case strings.HasSuffix(n, ".sha256"):
+				m[name].sums[strings.TrimSuffix(filepath.Base(n), ".sha256")] = string(b)
+			case strings.HasSuffix(n, ".skipped"):
+				m[name].skipped[strings.TrimSuffix(filepath.Base(n), ".skipped")] = true
+			case strings.HasSuffix(n, ".current"):
+				m[name].current[strings.TrimSuffix(filepath.Base(n), ".current")] = string(b)
 			case strings.HasSuffix(n, ".log") || strings.HasSuffix(n, ".failed"):
 				// ignore for now
 			default:
@@ -568,34 +749,40 @@ func doneFileToChecksum(in string) string {
 	return strings.TrimSuffix(filepath.Base(in), ".done")
 }
 
-func loadExecutedTasks(target Target, name string) (m map[string][]string, err error) {
-	c, err := target.Command("ls -t /var/lib/urknall/" + name + "/*.run | head -n 1 | xargs cat")
+func capture(target Target, cmd string) ([]byte, error) {
+	c, err := target.Command(cmd)
 	if err != nil {
 		return nil, err
 	}
+	if err := requestTargetPty(c); err != nil {
+		return nil, err
+	}
 	stdOut := &bytes.Buffer{}
 	stdErr := &bytes.Buffer{}
 	c.SetStderr(stdErr)
 	c.SetStdout(stdOut)
 	if err := c.Run(); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error running cmd=%s\nerr=\n%s\nstderr=%q", cmd, err.Error(), stdErr.String())
 	}
-	return nil, nil
+	return stdOut.Bytes(), nil
 }
 
-func capture(target Target, cmd string) ([]byte, error) {
-	c, err := target.Command(cmd)
-	if err != nil {
-		return nil, err
-	}
+// Run the given command, adding its stderr to the error returned on failure.
+func runCaptured(c target.ExecCommand) error {
+	_, err := runCapturedOutput(c)
+	return err
+}
+
+// Like runCaptured, but returns the command's stdout.
+func runCapturedOutput(c target.ExecCommand) (string, error) {
 	stdOut := &bytes.Buffer{}
 	stdErr := &bytes.Buffer{}
-	c.SetStderr(stdErr)
 	c.SetStdout(stdOut)
+	c.SetStderr(stdErr)
 	if err := c.Run(); err != nil {
-		return nil, fmt.Errorf("error running cmd=%s\nerr=\n%s\nstderr=%q", cmd, err.Error(), stdErr.String())
+		return "", fmt.Errorf("%s (stderr=%q)", err, stdErr.String())
 	}
-	return stdOut.Bytes(), nil
+	return stdOut.String(), nil
 }
 
 const (
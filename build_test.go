@@ -0,0 +1,310 @@
+package urknall
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dynport/urknall/cmd"
+	"github.com/dynport/urknall/target"
+	"github.com/dynport/urknall/urknalltest"
+)
+
+type execCommandStub struct {
+	forwarded bool
+}
+
+func (c *execCommandStub) StdoutPipe() (io.Reader, error)     { return &bytes.Buffer{}, nil }
+func (c *execCommandStub) StderrPipe() (io.Reader, error)     { return &bytes.Buffer{}, nil }
+func (c *execCommandStub) StdinPipe() (io.WriteCloser, error) { return nil, nil }
+func (c *execCommandStub) SetStdout(io.Writer)                {}
+func (c *execCommandStub) SetStderr(io.Writer)                {}
+func (c *execCommandStub) SetStdin(io.Reader)                 {}
+func (c *execCommandStub) Run() error                         { return nil }
+func (c *execCommandStub) Start() error                       { return nil }
+func (c *execCommandStub) Wait() error                        { return nil }
+
+type forwardingExecCommandStub struct {
+	execCommandStub
+}
+
+func (c *forwardingExecCommandStub) ForwardAgent() error {
+	c.forwarded = true
+	return nil
+}
+
+type agentCommand struct {
+	testCommand
+	forward bool
+}
+
+func (c *agentCommand) ForwardAgent() bool {
+	return c.forward
+}
+
+func TestConfigureExecCommandAgentForwarding(t *testing.T) {
+	ec := &forwardingExecCommandStub{}
+	if err := configureExecCommand(&agentCommand{forward: true}, ec); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if !ec.forwarded {
+		t.Errorf("expected agent to be forwarded")
+	}
+
+	ec = &forwardingExecCommandStub{}
+	if err := configureExecCommand(&agentCommand{forward: false}, ec); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if ec.forwarded {
+		t.Errorf("didn't expect agent to be forwarded")
+	}
+
+	if err := configureExecCommand(&agentCommand{forward: true}, &execCommandStub{}); err == nil {
+		t.Errorf("expected an error for targets not supporting agent forwarding, got none")
+	}
+}
+
+type ptyExecCommandStub struct {
+	execCommandStub
+	enabled   bool
+	requested bool
+}
+
+func (c *ptyExecCommandStub) RequestPty() error {
+	c.requested = true
+	return nil
+}
+
+func (c *ptyExecCommandStub) PtyEnabled() bool {
+	return c.enabled
+}
+
+type terminalCommand struct {
+	testCommand
+}
+
+func (c *terminalCommand) RequiresTerminal() bool {
+	return true
+}
+
+type stdinCommand struct {
+	testCommand
+}
+
+func (c *stdinCommand) Input() io.ReadCloser {
+	return ioutil.NopCloser(&bytes.Buffer{})
+}
+
+func TestConfigureExecCommandPty(t *testing.T) {
+	tests := []struct {
+		Command   cmd.Command
+		Enabled   bool
+		Requested bool
+	}{
+		{&testCommand{}, false, false},
+		{&testCommand{}, true, true},
+		{&terminalCommand{}, false, true},
+		{&stdinCommand{}, true, false},
+	}
+	for i, tst := range tests {
+		ec := &ptyExecCommandStub{enabled: tst.Enabled}
+		if err := configureExecCommand(tst.Command, ec); err != nil {
+			t.Fatalf("%d: didn't expect an error, got %q", i, err)
+		}
+		if ec.requested != tst.Requested {
+			t.Errorf("%d: expected PTY requested to be %t, was %t", i, tst.Requested, ec.requested)
+		}
+	}
+
+	if err := configureExecCommand(&terminalCommand{}, &execCommandStub{}); err == nil {
+		t.Errorf("expected an error for targets not supporting PTYs, got none")
+	}
+}
+
+type ptyTargetStub struct {
+	commands []*ptyExecCommandStub
+}
+
+func (t *ptyTargetStub) Command(string) (target.ExecCommand, error) {
+	c := &ptyExecCommandStub{enabled: true}
+	t.commands = append(t.commands, c)
+	return c, nil
+}
+
+func (t *ptyTargetStub) User() string   { return "ubuntu" }
+func (t *ptyTargetStub) String() string { return "stub" }
+func (t *ptyTargetStub) Reset() error   { return nil }
+
+func TestPrepareCommandPty(t *testing.T) {
+	tgt := &ptyTargetStub{}
+	b := &Build{Target: tgt}
+	if _, err := b.prepareCommand("true"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.prepareCommandWithStdin("cat"); err != nil {
+		t.Fatal(err)
+	}
+	if !tgt.commands[0].requested {
+		t.Errorf("expected PTY to be requested for internal commands")
+	}
+	if tgt.commands[1].requested {
+		t.Errorf("didn't expect PTY to be requested for commands reading stdin")
+	}
+}
+
+func newFakeTarget(t *testing.T) *urknalltest.Target {
+	ft, err := urknalltest.NewTarget()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ft
+}
+
+func threeCommands(p Package) {
+	p.AddCommands("base", Shell("echo 1"), Shell("echo 2"), Shell("echo 3"))
+}
+
+func TestBuildRunCaching(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+
+	if err := Run(ft, TemplateFunc(threeCommands)); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := ft.Executed(), []string{"echo 1", "echo 2", "echo 3"}; len(v) != len(ex) {
+		t.Fatalf("expected %q to be executed, got %q", ex, v)
+	}
+	state, err := ft.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state["base"]) != 3 {
+		t.Errorf("expected 3 checksums in state of task base, got %q", state["base"])
+	}
+
+	if err := Run(ft, TemplateFunc(threeCommands)); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v := ft.Executed(); len(v) != 3 {
+		t.Errorf("expected no commands to be executed on second run, got %q", v[3:])
+	}
+}
+
+func TestBuildRunRetryAfterFailure(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+
+	ft.Handle("^echo 2$", &urknalltest.Response{Stderr: "failed", ExitStatus: 1})
+	if err := Run(ft, TemplateFunc(threeCommands)); err == nil {
+		t.Fatalf("expected an error, got none")
+	}
+	if v, ex := strings.Join(ft.Executed(), ","), "echo 1,echo 2"; v != ex {
+		t.Errorf("expected executed commands to be %q, got %q", ex, v)
+	}
+	state, err := ft.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state["base"]) != 1 {
+		t.Errorf("expected 1 checksum in state of task base, got %q", state["base"])
+	}
+
+	ft.Handle("^echo 2$", &urknalltest.Response{})
+	if err := Run(ft, TemplateFunc(threeCommands)); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := strings.Join(ft.Executed(), ","), "echo 1,echo 2,echo 2,echo 3"; v != ex {
+		t.Errorf("expected executed commands to be %q, got %q", ex, v)
+	}
+}
+
+func TestBuildRunOverSSH(t *testing.T) {
+	srv, err := urknalltest.NewSSHServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.Password = "secret"
+	if srv.StateDir, err = ioutil.TempDir("", "urknall-state"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srv.StateDir)
+
+	tgt, err := NewSshTargetWithPassword("root@"+srv.Addr(), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tgt.Reset()
+
+	name := fmt.Sprintf("urknalltest-%d", time.Now().UnixNano())
+	out, err := ioutil.TempFile("", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+	tpl := TemplateFunc(func(p Package) {
+		p.AddCommands(name, Shell("echo 1 >> "+out.Name()), Shell("echo 2 >> "+out.Name()))
+	})
+
+	for i := 0; i < 2; i++ {
+		if err := Run(tgt, tpl); err != nil {
+			t.Fatalf("run %d: didn't expect an error, got %q", i, err)
+		}
+	}
+	m, err := readState(tgt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := m[name]; !ok || len(s.runSHAs) != 2 {
+		t.Errorf("expected 2 checksums in state of task %q, got %v", name, m[name])
+	}
+	b, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ex := string(b), "1\n2\n"; v != ex {
+		t.Errorf("expected the commands to be executed on the first run only (output %q), got %q", ex, v)
+	}
+}
+
+type shippingCommand struct {
+	path, content string
+}
+
+func (c *shippingCommand) Shell() string {
+	return "echo " + c.content + " > " + c.path
+}
+
+func (c *shippingCommand) ShipFile() (*cmd.File, error) {
+	return &cmd.File{Path: c.path, Content: ioutil.NopCloser(strings.NewReader(c.content))}, nil
+}
+
+func TestBuildRunShipsFiles(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+
+	content := strings.Repeat("x", 1024)
+	ut := &uploadTargetStub{Target: ft, uploads: map[string]string{}}
+	if err := Run(ut, TemplateFunc(func(p Package) {
+		p.AddCommands("base", &shippingCommand{path: "/etc/app.conf", content: content})
+	})); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v := ut.uploads["/etc/app.conf"]; v != content {
+		t.Errorf("expected file to be uploaded, got %q", v)
+	}
+	for _, c := range ft.Commands() {
+		if strings.Contains(c, content) {
+			t.Errorf("expected the shipped content to not be sent with commands, got %q", c)
+		}
+	}
+	if v := ft.Executed(); len(v) != 0 {
+		t.Errorf("expected shipped command to not be executed, got %q", v)
+	}
+}
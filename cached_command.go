@@ -4,7 +4,6 @@ import "github.com/dynport/urknall/cmd"
 
 type commandWrapper struct {
 	command cmd.Command
-	cached  bool
 
 	checksum string
 	logMsg   string
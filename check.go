@@ -0,0 +1,121 @@
+package urknall
+
+import "github.com/dynport/urknall/cmd"
+
+// A shortcut creating a build from the given target and template and checking
+// it (see Build.Check).
+func Check(target Target, tpl Template) (*CheckReport, error) {
+	return (&Build{Target: target, Template: tpl}).Check()
+}
+
+// Status of a command as determined by a check.
+type CheckStatus string
+
+const (
+	CheckInSync    CheckStatus = "in sync"
+	CheckDrifted   CheckStatus = "drifted"
+	CheckPending   CheckStatus = "pending"   // not executed yet (or changed since)
+	CheckUnchecked CheckStatus = "unchecked" // executed, but nothing to verify
+	CheckSkipped   CheckStatus = "skipped"   // skipped by its guard on the last build
+)
+
+// The result of checking a single command.
+type CommandCheck struct {
+	Command string      // Log message of the command.
+	Status  CheckStatus // Status of the command.
+	Output  string      // Output of the command's probe (if drifted).
+	Paths   []string    // Tracked paths modified since the command was executed.
+}
+
+// The results of checking the commands of a task.
+type TaskCheck struct {
+	Task     string
+	Commands []*CommandCheck
+}
+
+// Whether any of the task's commands drifted.
+func (tc *TaskCheck) Drifted() bool {
+	for _, c := range tc.Commands {
+		if c.Status == CheckDrifted {
+			return true
+		}
+	}
+	return false
+}
+
+// The drift report of a host.
+type CheckReport struct {
+	Host  string
+	Tasks []*TaskCheck
+}
+
+// Whether any of the host's tasks drifted.
+func (r *CheckReport) Drifted() bool {
+	for _, t := range r.Tasks {
+		if t.Drifted() {
+			return true
+		}
+	}
+	return false
+}
+
+// Check verifies the host is still in the state the build's template
+// describes, without executing any of its commands. Executed commands
+// implementing cmd.Checker are probed (unless their guard skipped them), and
+// the paths of commands implementing cmd.PathTracker are compared with the
+// hashes recorded. Nothing is written to the host.
+func (b *Build) Check() (*CheckReport, error) {
+	pkg, err := b.renderTemplate()
+	if err != nil {
+		return nil, err
+	}
+	m, err := readState(b.Target)
+	if err != nil {
+		return nil, err
+	}
+	migrateState(pkg, m)
+
+	r := &CheckReport{Host: b.Target.String()}
+	for _, t := range pkg.tasks {
+		tc := &TaskCheck{Task: t.name}
+		r.Tasks = append(r.Tasks, tc)
+
+		s, ok := m[t.name]
+		executed := ok
+		for i, c := range t.commands {
+			cs := c.Checksum()
+			cc := &CommandCheck{Command: c.LogMsg(), Status: CheckUnchecked}
+			tc.Commands = append(tc.Commands, cc)
+
+			executed = executed && i < len(s.runSHAs) && s.runSHAs[i] == cs
+			if !executed {
+				cc.Status = CheckPending
+				continue
+			}
+			if s.skipped[cs] {
+				cc.Status = CheckSkipped
+				continue
+			}
+			_, verified := s.sums[cs]
+			cc.Paths = s.drift(cs)
+			drifted := len(cc.Paths) > 0
+			if ch, ok := unwrapCommand(c.command).(cmd.Checker); ok && ch.Check() != "" {
+				inSync, out, err := b.probe(ch.Check())
+				if err != nil {
+					return nil, err
+				}
+				verified = true
+				if !inSync {
+					drifted, cc.Output = true, out
+				}
+			}
+			switch {
+			case drifted:
+				cc.Status = CheckDrifted
+			case verified:
+				cc.Status = CheckInSync
+			}
+		}
+	}
+	return r, nil
+}
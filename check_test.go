@@ -0,0 +1,167 @@
+package urknall
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dynport/urknall/urknalltest"
+)
+
+type checkingCommand struct {
+	cmd   string
+	check string
+}
+
+func (c *checkingCommand) Shell() string {
+	return c.cmd
+}
+
+func (c *checkingCommand) Check() string {
+	return c.check
+}
+
+func listFiles(t *testing.T, dir string) string {
+	files := []string{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err == nil {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(files, ",")
+}
+
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "urknall-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "managed.conf")
+	if err := ioutil.WriteFile(path, []byte("managed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ft := newFakeTarget(t)
+	defer ft.Close()
+
+	tpl := TemplateFunc(func(p Package) {
+		p.AddCommands("base",
+			&checkingCommand{cmd: "echo 1", check: "test -d /etc/checked"},
+			&trackingCommand{cmd: "echo 2", paths: []string{path}},
+			Shell("echo 3"),
+		)
+	})
+	statuses := func(r *CheckReport) string {
+		s := []string{}
+		for _, tc := range r.Tasks {
+			for _, c := range tc.Commands {
+				s = append(s, string(c.Status))
+			}
+		}
+		return strings.Join(s, ",")
+	}
+
+	r, err := Check(ft, tpl)
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := statuses(r), "pending,pending,pending"; v != ex {
+		t.Errorf("expected statuses to be %q, got %q", ex, v)
+	}
+	if _, err := os.Stat(ft.StateDir()); !os.IsNotExist(err) {
+		t.Errorf("expected check to not create the state directory")
+	}
+
+	if err := Run(ft, tpl); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	state := listFiles(t, ft.StateDir())
+	r, err = Check(ft, tpl)
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := statuses(r), "in sync,in sync,unchecked"; v != ex {
+		t.Errorf("expected statuses to be %q, got %q", ex, v)
+	}
+	if r.Drifted() {
+		t.Errorf("didn't expect report to be drifted")
+	}
+
+	ft.Handle("test -d /etc/checked", &urknalltest.Response{Stderr: "not found", ExitStatus: 1})
+	if err := ioutil.WriteFile(path, []byte("modified by hand"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err = Check(ft, tpl)
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := statuses(r), "drifted,drifted,unchecked"; v != ex {
+		t.Errorf("expected statuses to be %q, got %q", ex, v)
+	}
+	if c := r.Tasks[0].Commands[0]; c.Output != "not found" {
+		t.Errorf("expected probe output to be reported, got %q", c.Output)
+	}
+	if c := r.Tasks[0].Commands[1]; len(c.Paths) != 1 || c.Paths[0] != path {
+		t.Errorf("expected %q to be reported as drifted, got %q", path, c.Paths)
+	}
+	if !r.Drifted() {
+		t.Errorf("expected report to be drifted")
+	}
+
+	if v, ex := strings.Join(ft.Executed(), ","), "echo 1,echo 2,echo 3"; v != ex {
+		t.Errorf("expected checks to not execute commands, got %q", v)
+	}
+	if v := listFiles(t, ft.StateDir()); v != state {
+		t.Errorf("expected checks to not modify state, got %q (was %q)", v, state)
+	}
+}
+
+func TestCheckSkipsGuardedCommands(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+
+	tpl := TemplateFunc(func(p Package) {
+		p.AddCommands("base",
+			Shell("echo 1"),
+			Unless("test -f /etc/foo", &checkingCommand{cmd: "echo 2", check: "test -d /etc/checked"}),
+		)
+	})
+	ft.Handle("test -f /etc/foo", &urknalltest.Response{ExitStatus: 1})
+	ft.Handle("test -d /etc/checked", &urknalltest.Response{Stderr: "not found", ExitStatus: 1})
+	if err := Run(ft, tpl); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := strings.Join(ft.Executed(), ","), "echo 1"; v != ex {
+		t.Fatalf("expected executed commands to be %q, got %q", ex, v)
+	}
+
+	r, err := Check(ft, tpl)
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := r.Tasks[0].Commands[1].Status, CheckSkipped; v != ex {
+		t.Errorf("expected status of the skipped command to be %q, got %q", ex, v)
+	}
+	if r.Drifted() {
+		t.Errorf("didn't expect report to be drifted")
+	}
+
+	ft.Handle("test -f /etc/foo", &urknalltest.Response{})
+	if err := Run(ft, tpl); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	r, err = Check(ft, tpl)
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := r.Tasks[0].Commands[1].Status, CheckDrifted; v != ex {
+		t.Errorf("expected status of the executed command to be %q, got %q", ex, v)
+	}
+}
@@ -3,7 +3,11 @@
 // This package contains a set of interfaces, commands must or can implement.
 package cmd
 
-import "io"
+import (
+	"io"
+	"os"
+	"time"
+)
 
 // The Command interface is used to have specialized commands that are used for
 // execution and logging (the latter is useful to hide the gory details of more
@@ -39,3 +43,79 @@ type Renderer interface {
 type Validator interface {
 	Validate() error
 }
+
+// Commands that need to authenticate with the local SSH agent on the remote
+// host (cloning private repositories for example) can implement the
+// AgentForwarding interface. If ForwardAgent returns true the agent is
+// forwarded into the command's session. This is only supported by SSH targets.
+type AgentForwarding interface {
+	ForwardAgent() bool
+}
+
+// Some commands refuse to run without a terminal (sudo with "requiretty" set
+// for example). If RequiresTerminal returns true a pseudo terminal is allocated
+// for the command's session. Please note that stderr is merged into stdout in
+// that case. This is only supported by SSH targets.
+type TerminalRequirer interface {
+	RequiresTerminal() bool
+}
+
+// Commands that write a file on the host can implement the FileShipper
+// interface. If the target supports direct uploads the file's content is
+// streamed to the host that way, and the command's shell code is not executed.
+// Otherwise the command is executed as usual. The command's checksum is used
+// for caching in both cases.
+type FileShipper interface {
+	ShipFile() (*File, error)
+}
+
+// A file to be shipped to the host.
+type File struct {
+	Path    string        // Path of the file on the host.
+	Content io.ReadCloser // Content of the file (closed after the transfer).
+	Mode    os.FileMode   // Permissions of the file (0644 if not set).
+	Owner   string        // Owner of the file (root if empty).
+	Group   string        // Group of the file (the owner's login group if empty).
+}
+
+// Commands implementing the Guarded interface are only executed if the guard
+// (a shell probe run as root) succeeds. Unlike the command itself the guard is
+// never cached, but evaluated on every build before the plan is made. A
+// cached command is executed again if its guard succeeds. Guards must not
+// modify the host. An empty guard is ignored.
+type Guarded interface {
+	Guard() string
+}
+
+// Commands that must be executed on every build (like "apt-get update" or a
+// health check) can implement the AlwaysRunner interface. If AlwaysRun returns
+// true the command is executed even if it is cached. Subsequent commands of
+// the task are not affected.
+type AlwaysRunner interface {
+	AlwaysRun() bool
+}
+
+// Commands implementing the Expirer interface are executed again, once the
+// duration returned by CacheTTL has passed since their last execution. A zero
+// duration disables expiry. Subsequent commands of the task are not affected.
+type Expirer interface {
+	CacheTTL() time.Duration
+}
+
+// Commands that manage files on the host can implement the PathTracker
+// interface. The content hashes of the returned paths are recorded after the
+// command was executed and compared with the current ones on every build. If
+// a file was modified (or removed) in the meantime, the command is executed
+// again. Subsequent commands of the task are not affected.
+type PathTracker interface {
+	TrackedPaths() []string
+}
+
+// Commands implementing the Checker interface provide a read-only probe (run
+// as root), that verifies the host is still in the state the command
+// established. The probe must exit with a non zero status if it is not. It is
+// used by checks (see Build.Check) only, and must not modify the host. An
+// empty probe is ignored.
+type Checker interface {
+	Check() string
+}
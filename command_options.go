@@ -0,0 +1,165 @@
+package urknall
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dynport/urknall/cmd"
+	"github.com/dynport/urknall/utils"
+)
+
+// Execute the given command only if the guard succeeds (see cmd.Guarded).
+func OnlyIf(guard string, c cmd.Command) cmd.Command {
+	if guard == "" {
+		panic("empty guard given")
+	}
+	wc := wrapCommand(c)
+	wc.guard, wc.unless = guard, false
+	return wc
+}
+
+// Execute the given command only if the guard fails (see cmd.Guarded).
+func Unless(guard string, c cmd.Command) cmd.Command {
+	if guard == "" {
+		panic("empty guard given")
+	}
+	wc := wrapCommand(c)
+	wc.guard, wc.unless = guard, true
+	return wc
+}
+
+// Execute the given command on every build (see cmd.AlwaysRunner).
+func Always(c cmd.Command) cmd.Command {
+	wc := wrapCommand(c)
+	wc.always = true
+	return wc
+}
+
+// Execute the given command again once the given duration passed since its
+// last execution (see cmd.Expirer).
+func CacheFor(ttl time.Duration, c cmd.Command) cmd.Command {
+	wc := wrapCommand(c)
+	wc.ttl = ttl
+	return wc
+}
+
+// A command with the options set by the functions above. Options can be
+// combined, e.g. OnlyIf("test -f /etc/foo", Always(c)).
+type wrappedCommand struct {
+	cmd.Command
+	guard  string
+	unless bool
+	always bool
+	ttl    time.Duration
+}
+
+func wrapCommand(c cmd.Command) *wrappedCommand {
+	if wc, ok := c.(*wrappedCommand); ok {
+		cp := *wc
+		return &cp
+	}
+	return &wrappedCommand{Command: c}
+}
+
+// Options not set on the wrapper are taken from the wrapped command.
+func (wc *wrappedCommand) Guard() string {
+	switch {
+	case wc.unless:
+		return "! {\n" + wc.guard + "\n}"
+	case wc.guard != "":
+		return wc.guard
+	}
+	if g, ok := wc.Command.(cmd.Guarded); ok {
+		return g.Guard()
+	}
+	return ""
+}
+
+func (wc *wrappedCommand) AlwaysRun() bool {
+	return wc.always || isAlwaysRun(wc.Command)
+}
+
+func (wc *wrappedCommand) CacheTTL() time.Duration {
+	if wc.ttl != 0 {
+		return wc.ttl
+	}
+	if e, ok := wc.Command.(cmd.Expirer); ok {
+		return e.CacheTTL()
+	}
+	return 0
+}
+
+func (wc *wrappedCommand) Checksum() string {
+	cs, e := commandChecksum(wc.Command)
+	if e != nil {
+		panic(e)
+	}
+	return cs
+}
+
+func (wc *wrappedCommand) Logging() string {
+	if l, ok := wc.Command.(cmd.Logger); ok {
+		return l.Logging()
+	}
+	return wc.Command.Shell()
+}
+
+func (wc *wrappedCommand) Render(i interface{}) {
+	wc.guard = utils.MustRenderTemplate(wc.guard, i)
+	if r, ok := wc.Command.(cmd.Renderer); ok {
+		r.Render(i)
+	}
+}
+
+func (wc *wrappedCommand) Validate() error {
+	if wc.ttl < 0 {
+		return fmt.Errorf("negative cache ttl given: %s", wc.ttl)
+	}
+	if v, ok := wc.Command.(cmd.Validator); ok {
+		return v.Validate()
+	}
+	return nil
+}
+
+// Returns the command wrapped by the functions above, so that the optional
+// interfaces it implements can be used.
+func unwrapCommand(c cmd.Command) cmd.Command {
+	if wc, ok := c.(*wrappedCommand); ok {
+		return wc.Command
+	}
+	return c
+}
+
+func isAlwaysRun(c cmd.Command) bool {
+	ar, ok := c.(cmd.AlwaysRunner)
+	return ok && ar.AlwaysRun()
+}
+
+// Decides whether the given command is part of the build. Cached commands are
+// executed again if their guard passes, or (for unguarded commands) if they
+// must always run, their tracked paths drifted or their cache expired. Uncached commands are always part of
+// the build, but their shell code is skipped if the guard failed. The returned
+// note is shown in the plan.
+func planCommand(c cmd.Command, cached bool, doneAt time.Time, drift []string, guard *GuardResult) (execute, skip bool, note string) {
+	switch {
+	case guard != nil && guard.Passed:
+		return true, false, "guard passed"
+	case guard != nil && cached:
+		return false, false, ""
+	case guard != nil:
+		return true, true, "guard failed, skipped"
+	case !cached:
+		return true, false, ""
+	case isAlwaysRun(c):
+		return true, false, "always"
+	case len(drift) > 0:
+		return true, false, "drifted: " + strings.Join(drift, ", ")
+	}
+	if e, ok := c.(cmd.Expirer); ok && e.CacheTTL() > 0 {
+		if doneAt.IsZero() || time.Since(doneAt) >= e.CacheTTL() {
+			return true, false, "expired"
+		}
+	}
+	return false, false, ""
+}
@@ -0,0 +1,135 @@
+package urknall
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dynport/urknall/cmd"
+)
+
+type alwaysCommand struct {
+	testCommand
+}
+
+func (c *alwaysCommand) AlwaysRun() bool {
+	return true
+}
+
+func TestAlwaysRun(t *testing.T) {
+	for _, c := range []cmd.Command{Always(Shell("echo 2")), &alwaysCommand{testCommand{cmd: "echo 2"}}} {
+		ft := newFakeTarget(t)
+		defer ft.Close()
+
+		tpl := TemplateFunc(func(p Package) {
+			p.AddCommands("base", Shell("echo 1"), c, Shell("echo 3"))
+		})
+		for i := 0; i < 2; i++ {
+			if err := Run(ft, tpl); err != nil {
+				t.Fatalf("didn't expect an error, got %q", err)
+			}
+		}
+		if v, ex := strings.Join(ft.Executed(), ","), "echo 1,echo 2,echo 3,echo 2"; v != ex {
+			t.Errorf("expected executed commands of %T to be %q, got %q", c, ex, v)
+		}
+		state, err := ft.State()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(state["base"]) != 3 {
+			t.Errorf("expected rerun to keep all 3 checksums in state, got %q", state["base"])
+		}
+	}
+}
+
+func TestCacheFor(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+
+	tpl := TemplateFunc(func(p Package) {
+		p.AddCommands("base", CacheFor(time.Hour, Shell("echo 1")), Shell("echo 2"))
+	})
+	for i := 0; i < 2; i++ {
+		if err := Run(ft, tpl); err != nil {
+			t.Fatalf("didn't expect an error, got %q", err)
+		}
+	}
+	if v, ex := strings.Join(ft.Executed(), ","), "echo 1,echo 2"; v != ex {
+		t.Errorf("expected executed commands to be %q, got %q", ex, v)
+	}
+
+	files, err := filepath.Glob(filepath.Join(ft.StateDir(), "base", "*.done"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-2 * time.Hour)
+	for _, f := range files {
+		if err := os.Chtimes(f, past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := Run(ft, tpl); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := strings.Join(ft.Executed(), ","), "echo 1,echo 2,echo 1"; v != ex {
+		t.Errorf("expected expired command to be executed, got %q", v)
+	}
+}
+
+func TestPlanCommand(t *testing.T) {
+	passed, failed := &GuardResult{Passed: true}, &GuardResult{}
+	expiring := CacheFor(time.Hour, Shell("echo"))
+	tests := []struct {
+		c       cmd.Command
+		cached  bool
+		doneAt  time.Time
+		drift   []string
+		guard   *GuardResult
+		execute bool
+		skip    bool
+		note    string
+	}{
+		{Shell("echo"), false, time.Time{}, nil, nil, true, false, ""},
+		{Shell("echo"), true, time.Time{}, nil, nil, false, false, ""},
+		{Always(Shell("echo")), true, time.Time{}, nil, nil, true, false, "always"},
+		{Always(Shell("echo")), true, time.Time{}, nil, failed, false, false, ""},
+		{expiring, true, time.Now(), nil, nil, false, false, ""},
+		{expiring, true, time.Now().Add(-time.Hour), nil, nil, true, false, "expired"},
+		{expiring, true, time.Time{}, nil, nil, true, false, "expired"},
+		{Shell("echo"), true, time.Time{}, []string{"/a", "/b"}, nil, true, false, "drifted: /a, /b"},
+		{Always(Shell("echo")), true, time.Time{}, []string{"/a"}, nil, true, false, "always"},
+		{Shell("echo"), true, time.Time{}, nil, passed, true, false, "guard passed"},
+		{Shell("echo"), false, time.Time{}, nil, failed, true, true, "guard failed, skipped"},
+	}
+	for i, tc := range tests {
+		execute, skip, note := planCommand(tc.c, tc.cached, tc.doneAt, tc.drift, tc.guard)
+		if execute != tc.execute || skip != tc.skip || note != tc.note {
+			t.Errorf("%d: expected (%t, %t, %q), got (%t, %t, %q)", i, tc.execute, tc.skip, tc.note, execute, skip, note)
+		}
+	}
+}
+
+type optionsCommand struct {
+	testCommand
+	always bool
+	ttl    time.Duration
+	guard  string
+}
+
+func (c *optionsCommand) AlwaysRun() bool         { return c.always }
+func (c *optionsCommand) CacheTTL() time.Duration { return c.ttl }
+func (c *optionsCommand) Guard() string           { return c.guard }
+
+func TestWrappedCommandDelegatesOptions(t *testing.T) {
+	inner := &optionsCommand{always: true, ttl: time.Hour, guard: "test -f /etc/foo"}
+	wc := CacheFor(time.Minute, inner).(*wrappedCommand)
+	if !wc.AlwaysRun() || wc.CacheTTL() != time.Minute || wc.Guard() != inner.guard {
+		t.Errorf("expected unset options to be taken from the wrapped command, got %t, %s, %q", wc.AlwaysRun(), wc.CacheTTL(), wc.Guard())
+	}
+	wc = OnlyIf("true", &optionsCommand{ttl: time.Hour}).(*wrappedCommand)
+	if wc.AlwaysRun() || wc.CacheTTL() != time.Hour || wc.Guard() != "true" {
+		t.Errorf("expected options of the wrapper to take precedence, got %t, %s, %q", wc.AlwaysRun(), wc.CacheTTL(), wc.Guard())
+	}
+}
@@ -0,0 +1,68 @@
+package urknall
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type trackingCommand struct {
+	cmd   string
+	paths []string
+}
+
+func (c *trackingCommand) Shell() string {
+	return c.cmd
+}
+
+func (c *trackingCommand) TrackedPaths() []string {
+	return c.paths
+}
+
+func TestDriftedPathsTriggerRerun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "urknall-drift")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "managed file.conf")
+	if err := ioutil.WriteFile(path, []byte("managed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ft := newFakeTarget(t)
+	defer ft.Close()
+
+	tpl := TemplateFunc(func(p Package) {
+		p.AddCommands("base", &trackingCommand{cmd: "echo 1", paths: []string{path}}, Shell("echo 2"))
+	})
+	run := func() {
+		if err := Run(ft, tpl); err != nil {
+			t.Fatalf("didn't expect an error, got %q", err)
+		}
+	}
+	run()
+	run()
+	if v, ex := strings.Join(ft.Executed(), ","), "echo 1,echo 2"; v != ex {
+		t.Fatalf("expected executed commands to be %q, got %q", ex, v)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("modified by hand"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run()
+	if v, ex := strings.Join(ft.Executed(), ","), "echo 1,echo 2,echo 1"; v != ex {
+		t.Errorf("expected drifted command to be executed again, got %q", v)
+	}
+
+	run()
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	run()
+	if v, ex := strings.Join(ft.Executed(), ","), "echo 1,echo 2,echo 1,echo 1"; v != ex {
+		t.Errorf("expected removed file to trigger execution, got %q", v)
+	}
+}
@@ -1,6 +1,10 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/dynport/urknall/utils"
+)
 
 // AddUser adds a new linux user (normal or system user) if it does not exist already
 func AddUser(name string, systemUser bool) *ShellCommand {
@@ -11,5 +15,7 @@ func AddUser(name string, systemUser bool) *ShellCommand {
 	} else {
 		userAddOpts = "-m -s /bin/bash"
 	}
-	return Or(testForUser, fmt.Sprintf("useradd %s %s", userAddOpts, name))
+	c := Or(testForUser, fmt.Sprintf("useradd %s %s", userAddOpts, name))
+	c.check = "id " + utils.ShellQuote(name) + " > /dev/null"
+	return c
 }
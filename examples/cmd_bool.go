@@ -37,6 +37,9 @@ func Or(cmd interface{}, cmds ...interface{}) *ShellCommand {
 // The intention is to fail if a certain file exists. The problem is that this doesn't work out. The command must return
 // a positive return value if the file does not exit, but it won't. Use the "IfNot" method like in this statement:
 //	[[ ! -f /tmp/foo ]] || { echo "file exists" && exit 1; }
+//
+// The test is part of the cached command, i.e. it is only evaluated if the command changed. Use urknall.OnlyIf and
+// urknall.Unless for tests that must be evaluated on every build.
 func If(test string, i interface{}) *ShellCommand {
 	if test == "" {
 		panic("empty test given")
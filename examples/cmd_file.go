@@ -9,10 +9,12 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/dynport/urknall/cmd"
 	"github.com/dynport/urknall/utils"
 )
 
@@ -45,6 +47,11 @@ func (cmd *FileCommand) Validate() error {
 	return nil
 }
 
+// The file is written again if it was modified on the host.
+func (cmd *FileCommand) TrackedPaths() []string {
+	return []string{cmd.Path}
+}
+
 // Helper method to create a file at the given path with the given content, and with owner and permissions set
 // accordingly. The "Owner" and "Permissions" options are optional in the sense that they are ignored if set to go's
 // default value.
@@ -52,6 +59,19 @@ func WriteFile(path string, content string, owner string, permissions os.FileMod
 	return &FileCommand{Path: path, Content: content, Owner: owner, Permissions: permissions}
 }
 
+// Verifies content, owner and permissions of the file on the host.
+func (fc *FileCommand) Check() string {
+	path := utils.ShellQuote(fc.Path)
+	checks := []string{fmt.Sprintf(`test "$(sha256sum < %s | cut -d " " -f 1)" = %x`, path, sha256.Sum256([]byte(fc.Content)))}
+	if fc.Owner != "" {
+		checks = append(checks, fmt.Sprintf(`test "$(stat -c %%U %s)" = %s`, path, utils.ShellQuote(fc.Owner)))
+	}
+	if fc.Permissions > 0 {
+		checks = append(checks, fmt.Sprintf(`test "$(stat -c %%a %s)" = %o`, path, fc.Permissions))
+	}
+	return strings.Join(checks, " && ")
+}
+
 var b64 = base64.StdEncoding
 
 func (fc *FileCommand) Shell() string {
@@ -91,6 +111,17 @@ func (fc *FileCommand) Shell() string {
 	return cmd
 }
 
+// If the target supports uploads, the content is streamed to the host instead
+// of being inlined into the command.
+func (fc *FileCommand) ShipFile() (*cmd.File, error) {
+	return &cmd.File{
+		Path:    fc.Path,
+		Content: ioutil.NopCloser(strings.NewReader(fc.Content)),
+		Mode:    fc.Permissions,
+		Owner:   fc.Owner,
+	}, nil
+}
+
 func (fc *FileCommand) Logging() string {
 	sList := []string{"[FILE   ]"}
 
@@ -149,6 +180,11 @@ func (fsc *FileSendCommand) Validate() error {
 	return nil
 }
 
+// The file is sent again if it was modified on the host.
+func (fsc *FileSendCommand) TrackedPaths() []string {
+	return []string{fsc.Target}
+}
+
 func (fsc *FileSendCommand) sourceHash() string {
 	fh, e := os.Open(fsc.Source)
 	if e != nil {
@@ -185,6 +221,14 @@ func (fsc *FileSendCommand) Input() io.ReadCloser {
 	return fh
 }
 
+func (fsc *FileSendCommand) ShipFile() (*cmd.File, error) {
+	fh, e := os.Open(fsc.Source)
+	if e != nil {
+		return nil, e
+	}
+	return &cmd.File{Path: fsc.Target, Content: fh, Mode: fsc.Permissions, Owner: fsc.Owner}, nil
+}
+
 func (fsc *FileSendCommand) Logging() string {
 	sList := []string{"[FILE   ]"}
 
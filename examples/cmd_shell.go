@@ -18,6 +18,11 @@ import (
 type ShellCommand struct {
 	Command string // Command to be executed in the shell.
 	user    string // User to run the command as.
+	check   string // Read-only probe verifying the command's effect (see cmd.Checker).
+}
+
+func (cmd *ShellCommand) Check() string {
+	return cmd.check
 }
 
 func (cmd *ShellCommand) Render(i interface{}) {
@@ -25,6 +30,9 @@ func (cmd *ShellCommand) Render(i interface{}) {
 	if cmd.user != "" {
 		cmd.user = utils.MustRenderTemplate(cmd.user, i)
 	}
+	if cmd.check != "" {
+		cmd.check = utils.MustRenderTemplate(cmd.check, i)
+	}
 }
 
 func Shell(cmd string) *ShellCommand {
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"strings"
+
+	"github.com/dynport/urknall/utils"
 )
 
 // Upgrade the package cache and update the installed packages (using apt).
@@ -26,8 +28,13 @@ func UpdateSelectedRepoPackages(repoConfigPath string) *ShellCommand {
 
 // Install the given packages using apt-get. At least one package must be given (pkgs can be left empty).
 func InstallPackages(pkg string, pkgs ...string) *ShellCommand {
+	checks := []string{}
+	for _, p := range append([]string{pkg}, pkgs...) {
+		checks = append(checks, fmt.Sprintf(`test "$(dpkg-query -W -f='${Status}' %s 2> /dev/null)" = "install ok installed"`, utils.ShellQuote(p)))
+	}
 	return &ShellCommand{
 		Command: fmt.Sprintf("DEBIAN_FRONTEND=noninteractive apt-get install -y --no-install-recommends %s %s", pkg, strings.Join(pkgs, " ")),
+		check:   strings.Join(checks, " && "),
 	}
 }
 
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"log"
 	"os"
 
@@ -15,6 +17,10 @@ func main() {
 	}
 }
 
+func init() {
+	urknall.RegisterTemplate("hello", &Template{})
+}
+
 type Template struct {
 }
 
@@ -23,6 +29,16 @@ func (tpl *Template) Render(p urknall.Package) {
 }
 
 func run() error {
+	forceUnlock := flag.Bool("force-unlock", false, "take over the host's build lock held by another build")
+	schema := flag.Bool("schema", false, "print the JSON Schema of specs for the registered templates")
+	flag.Parse()
+	if *schema {
+		s, e := urknall.SpecSchema()
+		if e != nil {
+			return e
+		}
+		return json.NewEncoder(os.Stdout).Encode(s)
+	}
 	defer urknall.OpenLogger(os.Stdout).Close()
 	var target urknall.Target
 	var e error
@@ -36,5 +52,5 @@ func run() error {
 	if e != nil {
 		return e
 	}
-	return urknall.Run(target, &Template{})
+	return urknall.Run(target, &Template{}, func(b *urknall.Build) { b.ForceUnlock = *forceUnlock })
 }
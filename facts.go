@@ -0,0 +1,158 @@
+package urknall
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Facts about a host, gathered once per build before the template is
+// rendered. Fields the probe could not determine are left empty.
+type Facts struct {
+	OS             string   // kernel name, e.g. "Linux"
+	Distro         string   // distribution id from /etc/os-release, e.g. "ubuntu"
+	Version        string   // distribution version, e.g. "14.04"
+	Arch           string   // machine hardware name, e.g. "x86_64"
+	InitSystem     string   // one of "systemd", "upstart" or "sysvinit"
+	PackageManager string   // e.g. "apt-get", "yum" or "apk"
+	CPUs           int      // number of processing units
+	Memory         int64    // total memory in bytes
+	Hostname       string   // short hostname
+	FQDN           string   // fully qualified hostname
+	IPs            []string // addresses of all network interfaces (excluding loopback)
+}
+
+// Templates implementing this interface are handed the host's facts right
+// before they are rendered. Templates that are pointers to structs are copied
+// first (shallowly), i.e. the facts are set on the rendered copy only and the
+// template itself is left unmodified.
+type FactsAware interface {
+	SetFacts(*Facts)
+}
+
+// Packages rendered for a host implement this interface, see PackageFacts.
+type FactsProvider interface {
+	Facts() *Facts
+}
+
+// Returns the facts of the host the package is rendered for (nil if not
+// gathered).
+func PackageFacts(p Package) *Facts {
+	if fp, ok := p.(FactsProvider); ok {
+		return fp.Facts()
+	}
+	return nil
+}
+
+// HostFacts can be embedded into templates to have the host's facts available
+// as ".Facts" in rendered strings, e.g. "{{ .Facts.Distro }}". It must be
+// embedded by value, so that copies of the template don't share the facts.
+type HostFacts struct {
+	Facts *Facts `json:"-"` // set from the host, never from values
+}
+
+func (h *HostFacts) SetFacts(f *Facts) {
+	h.Facts = f
+}
+
+const factsCmd = `
+bash <<"EOF"
+[[ -f /etc/os-release ]] && . /etc/os-release
+echo "os=$(uname -s)"
+echo "distro=$ID"
+echo "version=$VERSION_ID"
+echo "arch=$(uname -m)"
+if [[ -d /run/systemd/system ]]; then
+  echo "init=systemd"
+elif initctl version 2> /dev/null | grep -q upstart; then
+  echo "init=upstart"
+elif [[ -d /etc/init.d ]]; then
+  echo "init=sysvinit"
+fi
+for pm in apt-get dnf yum zypper pacman apk; do
+  if which $pm > /dev/null 2>&1; then
+    echo "package_manager=$pm"
+    break
+  fi
+done
+echo "cpus=$(grep -c ^processor /proc/cpuinfo 2> /dev/null)"
+echo "memory_kb=$(awk '/^MemTotal:/ { print $2 }' /proc/meminfo 2> /dev/null)"
+echo "hostname=$(hostname -s 2> /dev/null || hostname)"
+echo "fqdn=$(hostname -f 2> /dev/null || hostname)"
+echo "ips=$(hostname -I 2> /dev/null)"
+EOF
+`
+
+// Returns a copy of the template to render with the given facts set (see
+// FactsAware). Validation and the facts modify the copy only, so that the
+// template can be rendered for several hosts concurrently.
+func withFacts(tpl Template, facts *Facts) Template {
+	tpl = copyTemplate(tpl)
+	if fa, ok := tpl.(FactsAware); ok && facts != nil {
+		fa.SetFacts(facts)
+	}
+	return tpl
+}
+
+// Returns a shallow copy of templates that are pointers to structs, and other
+// templates unchanged.
+func copyTemplate(tpl Template) Template {
+	v := reflect.ValueOf(tpl)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return tpl
+	}
+	c := reflect.New(v.Elem().Type())
+	c.Elem().Set(v.Elem())
+	return c.Interface().(Template)
+}
+
+func gatherFacts(target Target) (*Facts, error) {
+	b, err := capture(target, factsCmd)
+	if err != nil {
+		return nil, err
+	}
+	return parseFacts(b), nil
+}
+
+func parseFacts(b []byte) *Facts {
+	f := &Facts{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		kv := strings.SplitN(strings.TrimSpace(scanner.Text()), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch v := strings.Trim(kv[1], `"`); kv[0] {
+		case "os":
+			f.OS = v
+		case "distro":
+			f.Distro = v
+		case "version":
+			f.Version = v
+		case "arch":
+			f.Arch = v
+		case "init":
+			f.InitSystem = v
+		case "package_manager":
+			f.PackageManager = v
+		case "cpus":
+			f.CPUs, _ = strconv.Atoi(v)
+		case "memory_kb":
+			kb, _ := strconv.ParseInt(v, 10, 64)
+			f.Memory = kb * 1024
+		case "hostname":
+			f.Hostname = v
+		case "fqdn":
+			f.FQDN = v
+		case "ips":
+			for _, ip := range strings.Fields(v) {
+				if !strings.HasPrefix(ip, "127.") && ip != "::1" {
+					f.IPs = append(f.IPs, ip)
+				}
+			}
+		}
+	}
+	return f
+}
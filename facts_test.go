@@ -0,0 +1,113 @@
+package urknall
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dynport/urknall/urknalltest"
+)
+
+func TestParseFacts(t *testing.T) {
+	f := parseFacts([]byte(strings.Join([]string{
+		"os=Linux",
+		`distro="ubuntu"`,
+		`version="14.04"`,
+		"arch=x86_64",
+		"init=upstart",
+		"package_manager=apt-get",
+		"cpus=4",
+		"memory_kb=2048",
+		"hostname=web1",
+		"fqdn=web1.example.com",
+		"ips=10.0.0.1 127.0.0.1 fe80::1 ",
+		"garbage",
+	}, "\n")))
+	if f.Distro != "ubuntu" || f.Version != "14.04" || f.OS != "Linux" || f.Arch != "x86_64" {
+		t.Errorf("unexpected os facts: %+v", f)
+	}
+	if f.InitSystem != "upstart" || f.PackageManager != "apt-get" {
+		t.Errorf("unexpected system facts: %+v", f)
+	}
+	if f.CPUs != 4 || f.Memory != 2048*1024 {
+		t.Errorf("expected 4 cpus and 2MB memory, got %d and %d", f.CPUs, f.Memory)
+	}
+	if v, ex := strings.Join(f.IPs, ","), "10.0.0.1,fe80::1"; v != ex {
+		t.Errorf("expected ips to be %q, was %q", ex, v)
+	}
+}
+
+type factsChildTemplate struct {
+	HostFacts
+}
+
+func (tpl *factsChildTemplate) Render(p Package) {
+	p.AddCommands("install", &stringCommand{cmd: "{{ .Facts.PackageManager }} install curl"})
+}
+
+type factsTemplate struct {
+	HostFacts
+}
+
+func (tpl *factsTemplate) Render(p Package) {
+	p.AddCommands("base", &stringCommand{cmd: "echo {{ .Facts.Distro }}"}, Shell("echo "+PackageFacts(p).Hostname))
+	p.AddTemplate("child", &factsChildTemplate{})
+}
+
+func TestFactsAvailableToTemplates(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+	ft.Handle("os-release", &urknalltest.Response{Stdout: "distro=debian\npackage_manager=apt-get\nhostname=web1\n"})
+
+	tpl := &factsTemplate{}
+	b := &Build{Target: ft, Template: tpl}
+	if err := b.Run(); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := strings.Join(ft.Executed(), ","), "echo debian,echo web1,apt-get install curl"; v != ex {
+		t.Errorf("expected executed commands to be %q, got %q", ex, v)
+	}
+	if tpl.Facts != nil {
+		t.Errorf("expected the facts to be set on a copy of the template, got %+v", tpl.Facts)
+	}
+
+	if err := b.Run(); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	probes := 0
+	for _, c := range ft.Commands() {
+		if strings.Contains(c, "os-release") {
+			probes++
+		}
+	}
+	if probes != 1 {
+		t.Errorf("expected facts to be gathered once per build, got %d probes", probes)
+	}
+}
+
+type defaultedTemplate struct {
+	Version  string `urknall:"default=1.0"`
+	rendered string
+}
+
+func (tpl *defaultedTemplate) Render(p Package) {
+	tpl.rendered = tpl.Version
+	p.AddCommands("base", Shell("echo "+tpl.Version))
+}
+
+func TestBuildRendersCopyOfTemplate(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+
+	tpl := &defaultedTemplate{}
+	for _, f := range []func(Target, Template) error{DryRun, func(t Target, tpl Template) error { return Run(t, tpl) }} {
+		if err := f(ft, tpl); err != nil {
+			t.Fatalf("didn't expect an error, got %q", err)
+		}
+		if tpl.Version != "" || tpl.rendered != "" {
+			t.Errorf("expected the build's template to be unmodified, got %+v", tpl)
+		}
+	}
+	if v, ex := strings.Join(ft.Executed(), ","), "echo 1.0"; v != ex {
+		t.Errorf("expected the defaulted copy to be rendered, got %q", v)
+	}
+}
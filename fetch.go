@@ -0,0 +1,155 @@
+package urknall
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dynport/urknall/utils"
+)
+
+// The FetchCommand is used to copy files generated on the host (client
+// configurations or credentials for example) back to the controller. On the
+// host it only verifies the files exist. The files are fetched at the end of
+// each successful build (no matter whether the command was cached or not) and
+// stored below the build's FetchDir, namespaced by host. See the build's
+// Result for the list of fetched files.
+type FetchCommand struct {
+	Paths  []string // Paths of the files on the host.
+	Verify bool     // Verify the fetched content against the sha256 checksum computed on the host.
+}
+
+// Create a command that fetches the files at the given paths.
+func Fetch(paths ...string) *FetchCommand {
+	return &FetchCommand{Paths: paths}
+}
+
+func (fc *FetchCommand) Render(i interface{}) {
+	for j := range fc.Paths {
+		fc.Paths[j] = utils.MustRenderTemplate(fc.Paths[j], i)
+	}
+}
+
+func (fc *FetchCommand) Validate() error {
+	if len(fc.Paths) == 0 {
+		return fmt.Errorf("no paths given to fetch")
+	}
+	for _, p := range fc.Paths {
+		if !filepath.IsAbs(p) {
+			return fmt.Errorf("path to fetch must be absolute, got %q", p)
+		}
+	}
+	return nil
+}
+
+func (fc *FetchCommand) Shell() string {
+	quoted := []string{}
+	for _, p := range fc.Paths {
+		quoted = append(quoted, utils.ShellQuote(p))
+	}
+	return "ls -l " + strings.Join(quoted, " ")
+}
+
+func (fc *FetchCommand) Logging() string {
+	return "[FETCH  ] " + strings.Join(fc.Paths, ", ")
+}
+
+// A file fetched from the host.
+type FetchedFile struct {
+	Host       string // The host the file was fetched from.
+	RemotePath string // Path of the file on the host.
+	LocalPath  string // Path of the file on the controller.
+	Checksum   string // The sha256 checksum of the content.
+}
+
+func (b *Build) fetchDir() string {
+	if b.FetchDir == "" {
+		return "fetched"
+	}
+	return b.FetchDir
+}
+
+// Fetch the files of all FetchCommands of the given tasks.
+func (b *Build) fetchFiles(tasks []*task) error {
+	for _, t := range tasks {
+		for _, c := range t.commands {
+			fc, ok := unwrapCommand(c.command).(*FetchCommand)
+			if !ok {
+				continue
+			}
+			for _, p := range fc.Paths {
+				f, err := b.fetchFile(p, fc.Verify)
+				if err != nil {
+					return err
+				}
+				b.result.Fetched = append(b.result.Fetched, f)
+			}
+		}
+	}
+	return nil
+}
+
+func (b *Build) fetchFile(path string, verify bool) (*FetchedFile, error) {
+	f := &FetchedFile{
+		Host:       b.hostname(),
+		RemotePath: path,
+		LocalPath:  filepath.Join(b.fetchDir(), pathComponent(b.hostname()), filepath.Clean("/"+path)),
+	}
+	if err := os.MkdirAll(filepath.Dir(f.LocalPath), 0755); err != nil {
+		return nil, err
+	}
+	tmp := f.LocalPath + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+
+	c, err := b.prepareCommand("cat " + utils.ShellQuote(path))
+	if err != nil {
+		out.Close()
+		return nil, err
+	}
+	hash := sha256.New()
+	stderr := &bytes.Buffer{}
+	c.SetStdout(io.MultiWriter(out, hash))
+	c.SetStderr(stderr)
+	err = c.Run()
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %q: %s (%s)", path, err, stderr.String())
+	}
+	f.Checksum = fmt.Sprintf("%x", hash.Sum(nil))
+
+	if verify {
+		c, err := b.prepareCommand("sha256sum " + utils.ShellQuote(path))
+		if err != nil {
+			return nil, err
+		}
+		sum := &bytes.Buffer{}
+		c.SetStdout(sum)
+		if err := c.Run(); err != nil {
+			return nil, fmt.Errorf("failed to compute checksum of %q: %s", path, err)
+		}
+		if fields := strings.Fields(sum.String()); len(fields) == 0 || fields[0] != f.Checksum {
+			return nil, fmt.Errorf("checksum mismatch for fetched file %q", path)
+		}
+	}
+	return f, os.Rename(tmp, f.LocalPath)
+}
+
+// Make the given name (like a target's name) safe to be used as a single
+// component of local paths.
+func pathComponent(name string) string {
+	name = strings.NewReplacer("/", "_", "\\", "_", "\x00", "_").Replace(name)
+	if name == "" || name == "." || name == ".." {
+		return "_" + name
+	}
+	return name
+}
@@ -0,0 +1,81 @@
+package urknall
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFetchCommand(t *testing.T) {
+	c := Fetch("/etc/openvpn/{{ .Name }}.ovpn")
+	c.Render(struct{ Name string }{"client"})
+	if v, ex := c.Paths[0], "/etc/openvpn/client.ovpn"; v != ex {
+		t.Errorf("expected path to be %q, was %q", ex, v)
+	}
+	if v, ex := c.Shell(), "ls -l '/etc/openvpn/client.ovpn'"; v != ex {
+		t.Errorf("expected shell to be %q, was %q", ex, v)
+	}
+	if err := Fetch("relative/path").Validate(); err == nil {
+		t.Errorf("expected an error for relative paths, got none")
+	}
+}
+
+func TestFetchFiles(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("fetching from the local target requires root")
+	}
+	dir, err := ioutil.TempDir("", "urknall-fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	remote := filepath.Join(dir, "remote", "client.conf")
+	if err := os.MkdirAll(filepath.Dir(remote), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(remote, []byte("remote content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tgt, _ := NewLocalTarget()
+	b := &Build{Target: tgt, FetchDir: filepath.Join(dir, "fetched"), result: &Result{}}
+	fc := Fetch(remote)
+	fc.Verify = true
+	if err := b.fetchFiles([]*task{{commands: []*commandWrapper{{command: Always(fc)}}}}); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if len(b.Result().Fetched) != 1 {
+		t.Fatalf("expected %d fetched file, got %d", 1, len(b.Result().Fetched))
+	}
+	f := b.Result().Fetched[0]
+	if v, ex := f.LocalPath, filepath.Join(dir, "fetched", "LOCAL", remote); v != ex {
+		t.Errorf("expected local path to be %q, was %q", ex, v)
+	}
+	if v, ex := f.Checksum, "0709e9b00585ba4764fd4d89bdefec5b1a20b3735c50d8e33a27f740023ceca2"; v != ex {
+		t.Errorf("expected checksum to be %q, was %q", ex, v)
+	}
+	b2, err := ioutil.ReadFile(f.LocalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ex := string(b2), "remote content"; v != ex {
+		t.Errorf("expected content to be %q, was %q", ex, v)
+	}
+}
+
+func TestPathComponent(t *testing.T) {
+	tests := map[string]string{
+		"host.example.com": "host.example.com",
+		"10.0.0.1:2222":    "10.0.0.1:2222",
+		"../../etc":        ".._.._etc",
+		"a/b":              "a_b",
+		"..":               "_..",
+		"":                 "_",
+	}
+	for in, ex := range tests {
+		if v := pathComponent(in); v != ex {
+			t.Errorf("expected path component of %q to be %q, was %q", in, ex, v)
+		}
+	}
+}
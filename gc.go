@@ -0,0 +1,111 @@
+package urknall
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dynport/urknall/pubsub"
+
+	"github.com/dynport/urknall/utils"
+)
+
+// A retention policy for the build history kept on the host. A run is kept
+// if it is one of the KeepRuns newest of its task, or newer than MaxAge. The
+// newest run of each task (required for caching) is never removed. A policy
+// with neither limit set removes nothing.
+//
+// Note that a run is the execution of a single command, not a whole build:
+// every command executed writes its own build directory and run file. A build
+// executing three commands of a task adds three runs to its history.
+type Retention struct {
+	KeepRuns int           // Number of runs (executed commands) kept per task.
+	MaxAge   time.Duration // Runs newer than this are kept.
+}
+
+const gcCmd = `
+set -e
+cd /var/lib/urknall 2> /dev/null || exit 0
+keep=%d
+cutoff=%q
+
+for dir in $(find . -maxdepth 1 -mindepth 1 -type d); do
+  task=${dir#./}
+  # build directories and run files, newest first
+  for pattern in "build.*" "*.run"; do
+    i=0
+    for entry in $(cd $dir && ls -d $pattern 2> /dev/null | sort -r); do
+      i=$((i+1))
+      if [[ $i -eq 1 ]]; then
+        continue
+      fi
+      date=${entry#build.}
+      date=${date%%.run}
+      if [[ $keep -gt 0 && $i -le $keep ]] || [[ -n $cutoff && ! $date < $cutoff ]]; then
+        continue
+      fi
+      rm -rf $dir/$entry
+      echo "$task $entry"
+    done
+  done
+  # scripts, logs, hashes and markers not referenced by the remaining run files
+  referenced=$(cat $dir/*.run 2> /dev/null | xargs -r -n1 basename)
+  for done_file in $(cd $dir && ls *.done 2> /dev/null); do
+    if ! echo "$referenced" | grep -qxF $done_file; then
+      checksum=${done_file%%.done}
+      rm -f $dir/$checksum.done $dir/$checksum.log $dir/$checksum.sha256 $dir/$checksum.skipped
+      echo "$task $done_file"
+    fi
+  done
+  # scripts of failed commands
+  for failed_file in $(cd $dir && ls *.failed 2> /dev/null); do
+    if ! echo "$referenced" | grep -qxF $failed_file; then
+      rm -f $dir/$failed_file
+      echo "$task $failed_file"
+    fi
+  done
+done
+`
+
+// Apply the retention policy to the build history on the given target, while
+// holding the host's build lock. Returns the removed entries as
+// "<task>/<entry>". Each removal is published as
+// pubsub.MessageCleanupCacheEntries.
+func GC(target Target, r *Retention) (removed []string, err error) {
+	b := &Build{Target: target}
+	err = b.withLock(func() (e error) {
+		removed, e = b.gc(r)
+		return e
+	})
+	return removed, err
+}
+
+func (b *Build) gc(r *Retention) ([]string, error) {
+	if r == nil || (r.KeepRuns <= 0 && r.MaxAge <= 0) {
+		return nil, nil
+	}
+	cutoff := ""
+	if r.MaxAge > 0 {
+		cutoff = time.Now().Add(-r.MaxAge).UTC().Format("20060102_150405")
+	}
+	c, err := b.prepareCommand("bash -c " + utils.ShellQuote(fmt.Sprintf(gcCmd, r.KeepRuns, cutoff)))
+	if err != nil {
+		return nil, err
+	}
+	out, err := runCapturedOutput(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to clean up build history: %s", err)
+	}
+	removed := []string{}
+	for _, l := range strings.Split(strings.TrimSpace(out), "\n") {
+		f := strings.SplitN(l, " ", 2)
+		if len(f) != 2 {
+			continue
+		}
+		m := message(pubsub.MessageCleanupCacheEntries, b.hostname(), f[0])
+		m.Message = "removed " + f[1]
+		m.Publish("removed")
+		removed = append(removed, f[0]+"/"+f[1])
+	}
+	return removed, nil
+}
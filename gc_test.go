@@ -0,0 +1,124 @@
+package urknall
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Create a history of three runs of task "base" in the state of the target.
+func createHistory(t *testing.T, stateDir string) string {
+	dir := filepath.Join(stateDir, "base")
+	runs := map[string][]string{
+		"20200101_000000": {"a"},
+		"20200102_000000": {"b"},
+		"20200103_000000": {"b", "c"},
+	}
+	for date, checksums := range runs {
+		if err := os.MkdirAll(filepath.Join(dir, "build."+date), 0755); err != nil {
+			t.Fatal(err)
+		}
+		lines := []string{}
+		for _, cs := range checksums {
+			lines = append(lines, filepath.Join(dir, cs+".done"))
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, date+".run"), []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"a.done", "a.log", "b.done", "b.log", "c.done", "c.log", "teardown.sh"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func dirEntries(t *testing.T, dir string) string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, i := range infos {
+		names = append(names, i.Name())
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func TestGC(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+	dir := createHistory(t, ft.StateDir())
+
+	removed, err := GC(ft, &Retention{MaxAge: 24 * time.Hour * 365 * 100})
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if len(removed) != 0 {
+		t.Errorf("expected nothing to be removed, got %q", removed)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "d.failed"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	removed, err = GC(ft, &Retention{KeepRuns: 2})
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	sort.Strings(removed)
+	if v, ex := strings.Join(removed, ","), "base/20200101_000000.run,base/a.done,base/build.20200101_000000,base/d.failed"; v != ex {
+		t.Errorf("expected removed entries to be %q, got %q", ex, v)
+	}
+	if v, ex := dirEntries(t, dir), "20200102_000000.run,20200103_000000.run,b.done,b.log,build.20200102_000000,build.20200103_000000,c.done,c.log,teardown.sh"; v != ex {
+		t.Errorf("expected remaining entries to be %q, got %q", ex, v)
+	}
+
+	if _, err = GC(ft, &Retention{MaxAge: time.Hour}); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := dirEntries(t, dir), "20200103_000000.run,b.done,b.log,build.20200103_000000,c.done,c.log,teardown.sh"; v != ex {
+		t.Errorf("expected only the newest run to be kept, got %q", v)
+	}
+}
+
+func TestGCLockedHost(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+	dir := createHistory(t, ft.StateDir())
+	writeLock(t, ft.StateDir(), &LockedError{Holder: "alice@laptop", PID: 42, Started: time.Now().UTC().Truncate(time.Second)})
+
+	if _, err := GC(ft, &Retention{KeepRuns: 1}); err == nil {
+		t.Fatalf("expected GC of a locked host to fail")
+	} else if _, ok := err.(*LockedError); !ok {
+		t.Errorf("expected a LockedError, got %#v", err)
+	}
+	if v, ex := len(strings.Split(dirEntries(t, dir), ",")), 13; v != ex {
+		t.Errorf("expected %d entries to be kept, got %d", ex, v)
+	}
+}
+
+func TestBuildAppliesRetention(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+	createHistory(t, ft.StateDir())
+
+	b := &Build{Target: ft, Template: TemplateFunc(threeCommands), Retention: &Retention{KeepRuns: 1}}
+	if err := b.Run(); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if len(b.Result().Removed) == 0 {
+		t.Errorf("expected old runs to be removed")
+	}
+	if err := Run(ft, TemplateFunc(threeCommands)); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v := ft.Executed(); len(v) != 3 {
+		t.Errorf("expected retention to keep the cache intact, got %q", v)
+	}
+}
@@ -0,0 +1,53 @@
+package urknall
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/dynport/urknall/cmd"
+)
+
+// The result of a guard evaluated during a build.
+type GuardResult struct {
+	Task    string // Name of the task.
+	Command string // Log message of the guarded command.
+	Guard   string // The guard's shell code.
+	Passed  bool   // Whether the guarded command is executed.
+}
+
+// Run the command's guard on the target. Returns nil for unguarded commands.
+func (b *Build) evalGuard(taskName string, c *commandWrapper) (*GuardResult, error) {
+	g, ok := c.command.(cmd.Guarded)
+	if !ok || g.Guard() == "" {
+		return nil, nil
+	}
+	r := &GuardResult{Task: taskName, Command: c.LogMsg(), Guard: g.Guard()}
+	passed, out, err := b.probe(r.Guard)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate guard of %q in task %s: %s (output=%q)", r.Command, taskName, err, out)
+	}
+	r.Passed = passed
+	return r, nil
+}
+
+// Run the given shell code as root on the target. Returns whether the code
+// succeeded and its output. An error is only returned if the code could not
+// be executed.
+func (b *Build) probe(code string) (bool, string, error) {
+	ec, err := b.prepareCommand("bash <<\"UKPROBE\"\n" + code + "\nUKPROBE\n")
+	if err != nil {
+		return false, "", err
+	}
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	ec.SetStdout(stdout)
+	ec.SetStderr(stderr)
+	err = ec.Run()
+	out := stdout.String() + stderr.String()
+	if err != nil {
+		if _, ok := exitStatus(err); !ok {
+			return false, out, err
+		}
+		return false, out, nil
+	}
+	return true, out, nil
+}
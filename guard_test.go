@@ -0,0 +1,90 @@
+package urknall
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dynport/dgtk/confirm"
+	"github.com/dynport/urknall/urknalltest"
+)
+
+func guardedCommands(p Package) {
+	p.AddCommands("base", Shell("echo 1"), Unless("test -f /etc/foo", Shell("echo 2")), Shell("echo 3"))
+}
+
+func TestGuardedCommands(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+
+	ft.Handle("test -f /etc/foo", &urknalltest.Response{ExitStatus: 1})
+	b := &Build{Target: ft, Template: TemplateFunc(guardedCommands)}
+	if err := b.Run(); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := strings.Join(ft.Executed(), ","), "echo 1,echo 3"; v != ex {
+		t.Errorf("expected executed commands to be %q, got %q", ex, v)
+	}
+	if g := b.Result().Guards; len(g) != 1 || g[0].Passed || g[0].Task != "base" || g[0].Command != "echo 2" {
+		t.Errorf("expected a single failed guard in the result, got %+v", g)
+	}
+
+	ft.Handle("test -f /etc/foo", &urknalltest.Response{})
+	for i := 0; i < 2; i++ {
+		if err := b.Run(); err != nil {
+			t.Fatalf("didn't expect an error, got %q", err)
+		}
+		if g := b.Result().Guards; len(g) != 1 || !g[0].Passed {
+			t.Errorf("expected guard to pass, got %+v", g)
+		}
+	}
+	if v, ex := strings.Join(ft.Executed(), ","), "echo 1,echo 3,echo 2,echo 2"; v != ex {
+		t.Errorf("expected executed commands to be %q, got %q", ex, v)
+	}
+	state, err := ft.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state["base"]) != 3 {
+		t.Errorf("expected rerun to keep all 3 checksums in state, got %q", state["base"])
+	}
+}
+
+func TestGuardedCommandPlan(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+
+	ft.Handle("test -f /etc/foo", &urknalltest.Response{ExitStatus: 1})
+	names := []string{}
+	b := &Build{Target: ft, Template: TemplateFunc(guardedCommands), Confirm: func(actions ...*confirm.Action) error {
+		for _, a := range actions {
+			names = append(names, a.Key)
+		}
+		return nil
+	}}
+	if err := b.Run(); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := strings.Join(names, ","), "base echo 1,base echo 2 (guard failed, skipped),base echo 3"; v != ex {
+		t.Errorf("expected plan to be %q, got %q", ex, v)
+	}
+}
+
+func TestDryRunEvaluatesGuards(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+
+	ft.Handle("test -f /etc/foo", &urknalltest.Response{ExitStatus: 1})
+	b := &Build{Target: ft, Template: TemplateFunc(guardedCommands)}
+	if err := b.DryRun(); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if g := b.Result().Guards; len(g) != 1 || g[0].Passed {
+		t.Errorf("expected a single failed guard in the result, got %+v", g)
+	}
+	if v := ft.Executed(); len(v) != 0 {
+		t.Errorf("didn't expect commands to be executed, got %q", v)
+	}
+	if state, err := ft.State(); err != nil || len(state) != 0 {
+		t.Errorf("didn't expect state to be written, got %v (%v)", state, err)
+	}
+}
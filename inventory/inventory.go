@@ -0,0 +1,370 @@
+// Package inventory loads the hosts to build on from a JSON file.
+//
+// An inventory declares hosts, groups of hosts, connection settings and
+// variables:
+//
+//	{
+//	  "user": "ubuntu",
+//	  "key": "~/.ssh/id_rsa",
+//	  "vars": { "env": "production" },
+//	  "groups": {
+//	    "elasticsearch": {
+//	      "hosts": ["es1", "es2"],
+//	      "bastion": "jump.example.com",
+//	      "vars": { "heap_size": "4g" }
+//	    }
+//	  },
+//	  "hosts": {
+//	    "es1": { "address": "10.0.0.1" },
+//	    "es2": { "address": "10.0.0.2", "vars": { "heap_size": "8g" } }
+//	  }
+//	}
+//
+// Connection settings and variables are merged hierarchically: the top level
+// ones apply to all hosts, are overridden by those of the host's groups and
+// finally by the host's own.
+//
+// Groups are applied in alphabetical order of their names. If a host is member
+// of several groups setting the same connection setting or variable, the
+// value of the group whose name sorts last wins (e.g. a host of the groups
+// "db" and "web" gets the values of "web").
+//
+// Besides files, inventories can be generated by executables (e.g. querying
+// a cloud API, see ExecSource), cached (see Cached) and combined from several
+// sources (see Merge).
+package inventory
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dynport/urknall"
+	"github.com/dynport/urknall/target"
+)
+
+// Name selecting all hosts of an inventory.
+const All = "all"
+
+// Settings used to connect to a host via SSH.
+type Connection struct {
+	User    string `json:"user,omitempty"`    // Login (root if empty).
+	Port    int    `json:"port,omitempty"`    // SSH port (22 if empty).
+	Key     string `json:"key,omitempty"`     // Path of the private key (relative to the inventory file).
+	Bastion string `json:"bastion,omitempty"` // Host connections are tunneled through, of the form [<user>@]<host>[:<port>].
+}
+
+func (c *Connection) merge(o Connection) {
+	if o.User != "" {
+		c.User = o.User
+	}
+	if o.Port != 0 {
+		c.Port = o.Port
+	}
+	if o.Key != "" {
+		c.Key = o.Key
+	}
+	if o.Bastion != "" {
+		c.Bastion = o.Bastion
+	}
+}
+
+// Variables of hosts, groups or the inventory.
+type Vars map[string]interface{}
+
+func (v Vars) merge(o Vars) {
+	for k, val := range o {
+		v[k] = val
+	}
+}
+
+// A group of hosts sharing connection settings and variables.
+type Group struct {
+	Connection
+	Hosts []string `json:"hosts"`
+	Vars  Vars     `json:"vars,omitempty"`
+}
+
+// A host as declared in the inventory.
+type Host struct {
+	Connection
+	Address string `json:"address,omitempty"` // Address to connect to (the host's name if empty).
+	Vars    Vars   `json:"vars,omitempty"`
+}
+
+// An inventory of hosts. Use Load or Parse to create one.
+type Inventory struct {
+	Connection                   // Connection settings of all hosts.
+	Vars       Vars              `json:"vars,omitempty"` // Variables of all hosts.
+	Groups     map[string]*Group `json:"groups,omitempty"`
+	Hosts      map[string]*Host  `json:"hosts"`
+
+	dir string // directory relative key paths are resolved in
+}
+
+// Load the inventory from the given file.
+func Load(path string) (*Inventory, error) {
+	i, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := i.validate(); err != nil {
+		return nil, fmt.Errorf("failed to load inventory %s: %s", path, err)
+	}
+	return i, nil
+}
+
+// Like Load, but the inventory isn't validated (see parse).
+func load(path string) (*Inventory, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	i, err := parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load inventory %s: %s", path, err)
+	}
+	i.dir = filepath.Dir(path)
+	return i, nil
+}
+
+// Parse an inventory. Relative key paths are resolved in the current working
+// directory.
+func Parse(r io.Reader) (*Inventory, error) {
+	i, err := parse(r)
+	if err != nil {
+		return nil, err
+	}
+	return i, i.validate()
+}
+
+// Like Parse, but the inventory isn't validated. Used for inventories that are
+// only complete once merged with others (see Merge).
+func parse(r io.Reader) (*Inventory, error) {
+	i := &Inventory{}
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(i); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+func (i *Inventory) validate() error {
+	if len(i.Hosts) == 0 {
+		return fmt.Errorf("no hosts given")
+	}
+	for name, h := range i.Hosts {
+		if h == nil {
+			return fmt.Errorf("host %q must be an object", name)
+		}
+		if _, ok := i.Groups[name]; ok || name == All {
+			return fmt.Errorf("host %q conflicts with group of the same name", name)
+		}
+	}
+	for name, g := range i.Groups {
+		if name == All {
+			return fmt.Errorf("group %q is reserved", All)
+		}
+		if g == nil {
+			return fmt.Errorf("group %q must be an object", name)
+		}
+		for _, h := range g.Hosts {
+			if _, ok := i.Hosts[h]; !ok {
+				return fmt.Errorf("group %q references unknown host %q", name, h)
+			}
+		}
+	}
+	return nil
+}
+
+// A host with the connection settings and variables merged from the
+// inventory and its groups.
+type ResolvedHost struct {
+	Connection
+	Name    string
+	Address string
+	Groups  []string // Names of the groups the host is member of.
+	Vars    Vars
+
+	dir string
+}
+
+// Returns the host of the given name. The settings of its groups are applied
+// in alphabetical order of the group names (see the package documentation).
+func (i *Inventory) Host(name string) (*ResolvedHost, error) {
+	h, ok := i.Hosts[name]
+	if !ok {
+		return nil, fmt.Errorf("host %q not found in inventory", name)
+	}
+	r := &ResolvedHost{Name: name, Address: h.Address, Connection: i.Connection, Vars: Vars{}, dir: i.dir}
+	if r.Address == "" {
+		r.Address = name
+	}
+	r.Vars.merge(i.Vars)
+	for _, g := range i.groupNames() {
+		for _, member := range i.Groups[g].Hosts {
+			if member == name {
+				r.Groups = append(r.Groups, g)
+				r.Connection.merge(i.Groups[g].Connection)
+				r.Vars.merge(i.Groups[g].Vars)
+				break
+			}
+		}
+	}
+	r.Connection.merge(h.Connection)
+	r.Vars.merge(h.Vars)
+	return r, nil
+}
+
+// Returns the hosts selected by the given host or group names ("all" selects
+// all hosts), ordered by name. All hosts are returned if no name is given.
+func (i *Inventory) Select(names ...string) ([]*ResolvedHost, error) {
+	hostNames, err := i.HostNames(names...)
+	if err != nil {
+		return nil, err
+	}
+	hosts := []*ResolvedHost{}
+	for _, name := range hostNames {
+		h, err := i.Host(name)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, nil
+}
+
+// Returns the names of the hosts selected by the given names (see Select).
+func (i *Inventory) HostNames(names ...string) ([]string, error) {
+	if len(names) == 0 {
+		names = []string{All}
+	}
+	selected := map[string]struct{}{}
+	for _, name := range names {
+		switch g, ok := i.Groups[name]; {
+		case name == All:
+			for h := range i.Hosts {
+				selected[h] = struct{}{}
+			}
+		case ok:
+			for _, h := range g.Hosts {
+				selected[h] = struct{}{}
+			}
+		default:
+			if _, ok := i.Hosts[name]; !ok {
+				return nil, fmt.Errorf("no host or group %q in inventory", name)
+			}
+			selected[name] = struct{}{}
+		}
+	}
+
+	hostNames := []string{}
+	for name := range selected {
+		hostNames = append(hostNames, name)
+	}
+	sort.Strings(hostNames)
+	return hostNames, nil
+}
+
+// Returns the targets of the hosts selected by the given names (see Select).
+func (i *Inventory) Targets(names ...string) ([]urknall.Target, error) {
+	hosts, err := i.Select(names...)
+	if err != nil {
+		return nil, err
+	}
+	targets := []urknall.Target{}
+	for _, h := range hosts {
+		t, err := h.Target()
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// Returns the target of the host of the given name.
+func (i *Inventory) Target(name string) (urknall.Target, error) {
+	h, err := i.Host(name)
+	if err != nil {
+		return nil, err
+	}
+	return h.Target()
+}
+
+func (i *Inventory) groupNames() []string {
+	names := []string{}
+	for name := range i.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the SSH address of the host, of the form <user>@<host>:<port>.
+func (h *ResolvedHost) SshAddress() string {
+	addr := h.Address
+	if h.User != "" {
+		addr = h.User + "@" + addr
+	}
+	if h.Port != 0 {
+		addr = fmt.Sprintf("%s:%d", addr, h.Port)
+	}
+	return addr
+}
+
+// Create a SSH target for the host. The key (if given) is used for the host
+// and its bastion.
+func (h *ResolvedHost) Target() (urknall.Target, error) {
+	var key []byte
+	if h.Key != "" {
+		var err error
+		if key, err = ioutil.ReadFile(h.keyPath()); err != nil {
+			return nil, fmt.Errorf("failed to read key of host %q: %s", h.Name, err)
+		}
+	}
+	t, err := target.NewSshTargetWithPrivateKey(h.SshAddress(), key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address of host %q: %s", h.Name, err)
+	}
+	if h.Bastion != "" {
+		if t.Bastion, err = target.NewSshTargetWithPrivateKey(h.Bastion, key); err != nil {
+			return nil, fmt.Errorf("invalid bastion of host %q: %s", h.Name, err)
+		}
+	}
+	return t, nil
+}
+
+func (h *ResolvedHost) keyPath() string {
+	switch {
+	case strings.HasPrefix(h.Key, "~/"):
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, h.Key[2:])
+		}
+	case !filepath.IsAbs(h.Key) && h.dir != "":
+		return filepath.Join(h.dir, h.Key)
+	}
+	return h.Key
+}
+
+// Decode the host's variables into the given template (or any other pointer
+// to a struct), so that they can feed its fields. Variables are matched to
+// fields like encoding/json does, i.e. by the json tag or case insensitive
+// field name; unknown variables are ignored.
+func (h *ResolvedHost) DecodeVars(tpl interface{}) error {
+	b, err := json.Marshal(h.Vars)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, tpl); err != nil {
+		return fmt.Errorf("failed to decode vars of host %q: %s", h.Name, err)
+	}
+	return nil
+}
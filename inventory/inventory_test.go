@@ -0,0 +1,214 @@
+package inventory
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testInventory = `{
+  "user": "ubuntu",
+  "vars": { "env": "production", "heap_size": "1g" },
+  "groups": {
+    "elasticsearch": {
+      "hosts": ["es1", "es2"],
+      "bastion": "jump@bastion.example.com",
+      "vars": { "heap_size": "4g", "cluster": "search" }
+    },
+    "monitored": {
+      "hosts": ["es2", "db1"],
+      "port": 2222,
+      "vars": { "heap_size": "2g" }
+    }
+  },
+  "hosts": {
+    "es1": { "address": "10.0.0.1" },
+    "es2": { "address": "10.0.0.2", "user": "admin", "vars": { "heap_size": "8g" } },
+    "db1": { "key": "keys/db" }
+  }
+}`
+
+func names(hosts []*ResolvedHost) string {
+	n := []string{}
+	for _, h := range hosts {
+		n = append(n, h.Name)
+	}
+	return strings.Join(n, ",")
+}
+
+func TestHost(t *testing.T) {
+	i, err := Parse(strings.NewReader(testInventory))
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+
+	tests := []struct {
+		Name    string
+		Address string
+		Groups  string
+		Bastion string
+		Heap    string
+	}{
+		{"es1", "ubuntu@10.0.0.1", "elasticsearch", "jump@bastion.example.com", "4g"},
+		{"es2", "admin@10.0.0.2:2222", "elasticsearch,monitored", "jump@bastion.example.com", "8g"},
+		{"db1", "ubuntu@db1:2222", "monitored", "", "2g"},
+	}
+	for _, tst := range tests {
+		h, err := i.Host(tst.Name)
+		if err != nil {
+			t.Fatalf("didn't expect an error, got %q", err)
+		}
+		if v := h.SshAddress(); v != tst.Address {
+			t.Errorf("expected address of %s to be %q, got %q", tst.Name, tst.Address, v)
+		}
+		if v := strings.Join(h.Groups, ","); v != tst.Groups {
+			t.Errorf("expected groups of %s to be %q, got %q", tst.Name, tst.Groups, v)
+		}
+		if h.Bastion != tst.Bastion {
+			t.Errorf("expected bastion of %s to be %q, got %q", tst.Name, tst.Bastion, h.Bastion)
+		}
+		if v := h.Vars["heap_size"]; v != tst.Heap {
+			t.Errorf("expected heap size of %s to be %q, got %q", tst.Name, tst.Heap, v)
+		}
+		if v := h.Vars["env"]; v != "production" {
+			t.Errorf("expected env of %s to be %q, got %q", tst.Name, "production", v)
+		}
+	}
+
+	if _, err := i.Host("unknown"); err == nil {
+		t.Errorf("expected unknown host to fail")
+	}
+}
+
+func TestSelect(t *testing.T) {
+	i, err := Parse(strings.NewReader(testInventory))
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	tests := []struct {
+		Names    []string
+		Expected string
+	}{
+		{nil, "db1,es1,es2"},
+		{[]string{"all"}, "db1,es1,es2"},
+		{[]string{"elasticsearch"}, "es1,es2"},
+		{[]string{"elasticsearch", "db1"}, "db1,es1,es2"},
+		{[]string{"es2", "monitored"}, "db1,es2"},
+	}
+	for _, tst := range tests {
+		hosts, err := i.Select(tst.Names...)
+		if err != nil {
+			t.Fatalf("didn't expect an error, got %q", err)
+		}
+		if v := names(hosts); v != tst.Expected {
+			t.Errorf("expected %v to select %q, got %q", tst.Names, tst.Expected, v)
+		}
+	}
+	if _, err := i.Select("web"); err == nil {
+		t.Errorf("expected selecting unknown group to fail")
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, in := range []string{
+		`{}`,
+		`{"hosts": {"a": {}}, "groups": {"g": {"hosts": ["b"]}}}`,
+		`{"hosts": {"a": {}}, "groups": {"a": {"hosts": ["a"]}}}`,
+		`{"hosts": {"all": {}}}`,
+		`{"hosts": {"a": {"adress": "typo"}}}`,
+	} {
+		if _, err := Parse(strings.NewReader(in)); err == nil {
+			t.Errorf("expected %s to be invalid", in)
+		}
+	}
+}
+
+func TestGroupPrecedence(t *testing.T) {
+	i, err := Parse(strings.NewReader(`{
+		"groups": {
+			"web": {"hosts": ["a"], "user": "web", "vars": {"role": "web"}},
+			"db": {"hosts": ["a"], "user": "db", "port": 2222, "vars": {"role": "db"}}
+		},
+		"hosts": {"a": {}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := i.Host("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.User != "web" || h.Port != 2222 || h.Vars["role"] != "web" {
+		t.Errorf("expected the settings of group web to take precedence, got %+v", h)
+	}
+}
+
+func TestParseNullEntries(t *testing.T) {
+	for in, ex := range map[string]string{
+		`{"hosts": {"a": {}, "b": null}}`:                                    `host "b" must be an object`,
+		`{"hosts": {"a": {}}, "groups": {"g": null}}`:                        `group "g" must be an object`,
+		`{"hosts": {"a": {}}, "groups": {"g": {"hosts": ["a"]}, "h": null}}`: `group "h" must be an object`,
+	} {
+		if _, err := Parse(strings.NewReader(in)); err == nil || err.Error() != ex {
+			t.Errorf("expected parsing %s to fail with %q, got %v", in, ex, err)
+		}
+	}
+}
+
+func TestTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "inventory.json")
+	if err := ioutil.WriteFile(path, []byte(testInventory), 0644); err != nil {
+		t.Fatal(err)
+	}
+	i, err := Load(path)
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+
+	if _, err := i.Targets("db1"); err == nil || !strings.Contains(err.Error(), "keys/db") {
+		t.Errorf("expected missing key relative to the inventory to fail, got %v", err)
+	}
+	targets, err := i.Targets("elasticsearch")
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if len(targets) != 2 || targets[0].String() != "10.0.0.1" || targets[1].User() != "admin" {
+		t.Errorf("expected targets of es1 and es2, got %v", targets)
+	}
+	names, err := i.HostNames("elasticsearch")
+	if err != nil || strings.Join(names, ",") != "es1,es2" {
+		t.Errorf("expected host names es1 and es2, got %v (%v)", names, err)
+	}
+	if tgt, err := i.Target("es2"); err != nil || tgt.User() != "admin" {
+		t.Errorf("expected target of es2, got %v (%v)", tgt, err)
+	}
+}
+
+func TestDecodeVars(t *testing.T) {
+	i, err := Parse(strings.NewReader(testInventory))
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	h, err := i.Host("es2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &struct {
+		Cluster  string
+		HeapSize string `json:"heap_size"`
+		Version  string
+	}{Version: "1.7"}
+	if err := h.DecodeVars(tpl); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if tpl.Cluster != "search" || tpl.HeapSize != "8g" || tpl.Version != "1.7" {
+		t.Errorf("unexpected template after decoding vars: %#v", tpl)
+	}
+}
@@ -0,0 +1,305 @@
+package inventory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A source provides an inventory, e.g. loaded from a file or generated by an
+// external program.
+type Source interface {
+	Inventory() (*Inventory, error)
+}
+
+// Implemented by the sources of this package, to provide their inventories
+// unvalidated when merged (see Merge). The returned functions store the
+// inventories of cached sources; they must only be called once the inventory
+// is validated.
+type partialSource interface {
+	partialInventory() (*Inventory, []func() error, error)
+}
+
+// Returns the inventory of the given source, unvalidated if it is supported by
+// the source.
+func partialInventory(src Source) (*Inventory, []func() error, error) {
+	if p, ok := src.(partialSource); ok {
+		return p.partialInventory()
+	}
+	i, err := src.Inventory()
+	return i, nil, err
+}
+
+// Validate the given inventory and store it in the caches of its sources.
+func validated(i *Inventory, stores []func() error) (*Inventory, error) {
+	if err := i.validate(); err != nil {
+		return nil, err
+	}
+	for _, store := range stores {
+		if err := store(); err != nil {
+			return nil, err
+		}
+	}
+	return i, nil
+}
+
+// Source loading the inventory from the file at the given path.
+type FileSource string
+
+func (f FileSource) Inventory() (*Inventory, error) {
+	return Load(string(f))
+}
+
+func (f FileSource) partialInventory() (*Inventory, []func() error, error) {
+	i, err := load(string(f))
+	return i, nil, err
+}
+
+// Source running an executable that prints the inventory to stdout. The output
+// must be of the same JSON format as inventory files (see the package
+// documentation), e.g. generated from a cloud API or CMDB:
+//
+//	{
+//	  "groups": { "web": { "hosts": ["web1"] } },
+//	  "hosts": { "web1": { "address": "10.0.0.1", "vars": { "zone": "a" } } }
+//	}
+//
+// The executable must exit with status 0; stderr is included in the error
+// otherwise. Relative key paths are resolved in the current working directory.
+type ExecSource struct {
+	Path    string        // Executable to run (looked up in PATH if it contains no slash).
+	Args    []string      // Arguments passed to the executable.
+	Env     []string      // Environment variables in the form `KEY=VALUE`, added to the current environment.
+	Timeout time.Duration // The executable is killed after this duration (no timeout if zero).
+}
+
+func (e *ExecSource) Inventory() (*Inventory, error) {
+	i, _, err := e.partialInventory()
+	if err != nil {
+		return nil, err
+	}
+	if err := i.validate(); err != nil {
+		return nil, fmt.Errorf("invalid inventory from %s: %s", e, err)
+	}
+	return i, nil
+}
+
+func (e *ExecSource) partialInventory() (*Inventory, []func() error, error) {
+	ctx := context.Background()
+	if e.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.Timeout)
+		defer cancel()
+	}
+	c := exec.CommandContext(ctx, e.Path, e.Args...)
+	c.Env = append(os.Environ(), e.Env...)
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	c.Stdout = stdout
+	c.Stderr = stderr
+	if err := c.Run(); err != nil {
+		return nil, nil, fmt.Errorf("inventory source %s failed: %s (stderr=%q)", e, err, stderr.String())
+	}
+	i, err := parse(stdout)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid inventory from %s: %s", e, err)
+	}
+	return i, nil, nil
+}
+
+func (e *ExecSource) String() string {
+	return strings.Join(append([]string{e.Path}, e.Args...), " ")
+}
+
+// Source caching the inventory of another source in the file at the given
+// path. The cached inventory is used as long as it is younger than the TTL.
+// Inventories are only cached once validated (when merged, the merged
+// inventory is validated), so invalid inventories are fetched again.
+type CachedSource struct {
+	Source
+	Path string
+	TTL  time.Duration
+}
+
+// Cache the inventory of the given source in the file at path for the given
+// duration.
+func Cached(src Source, path string, ttl time.Duration) *CachedSource {
+	return &CachedSource{Source: src, Path: path, TTL: ttl}
+}
+
+func (c *CachedSource) Inventory() (*Inventory, error) {
+	i, stores, err := c.partialInventory()
+	if err != nil {
+		return nil, err
+	}
+	return validated(i, stores)
+}
+
+func (c *CachedSource) partialInventory() (*Inventory, []func() error, error) {
+	if fi, err := os.Stat(c.Path); err == nil && time.Since(fi.ModTime()) < c.TTL {
+		f, err := os.Open(c.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer f.Close()
+		i, err := parse(f)
+		if err == nil {
+			return i, nil, nil
+		}
+		// ignore broken caches, the inventory is fetched again
+	}
+
+	i, stores, err := partialInventory(c.Source)
+	if err != nil {
+		return nil, nil, err
+	}
+	i.resolveKeys()
+	b, err := json.Marshal(i)
+	if err != nil {
+		return nil, nil, err
+	}
+	return i, append(stores, func() error { return c.store(b) }), nil
+}
+
+func (c *CachedSource) store(b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(c.Path), 0755); err != nil {
+		return err
+	}
+	// write to a temporary file first, so readers never see partial caches
+	tmp, err := ioutil.TempFile(filepath.Dir(c.Path), ".inventory")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.Path)
+}
+
+// Combine the inventories of the given sources. They are merged in order:
+// hosts and groups of the same name are merged (the members of groups are
+// joined), with connection settings and variables of later sources taking
+// precedence. Thereby e.g. a CMDB can add variables to hosts of a cloud API.
+// The inventories of the sources of this package are validated only once
+// merged, so they may be incomplete on their own (like groups referencing
+// hosts of another source).
+func Merge(sources ...Source) Source {
+	return multiSource(sources)
+}
+
+type multiSource []Source
+
+func (m multiSource) Inventory() (*Inventory, error) {
+	merged, stores, err := m.partialInventory()
+	if err != nil {
+		return nil, err
+	}
+	return validated(merged, stores)
+}
+
+func (m multiSource) partialInventory() (*Inventory, []func() error, error) {
+	merged := &Inventory{Vars: Vars{}, Groups: map[string]*Group{}, Hosts: map[string]*Host{}}
+	stores := []func() error{}
+	for _, src := range m {
+		i, s, err := partialInventory(src)
+		if err != nil {
+			return nil, nil, err
+		}
+		merged.merge(i)
+		stores = append(stores, s...)
+	}
+	return merged, stores, nil
+}
+
+// Merge the given inventory into this one. The given inventory isn't modified.
+func (i *Inventory) merge(o *Inventory) {
+	i.Connection.merge(o.resolveKey(o.Connection))
+	i.Vars.merge(o.Vars)
+	for name, g := range o.Groups {
+		mg, ok := i.Groups[name]
+		if g == nil {
+			if !ok {
+				i.Groups[name] = nil // rejected by validation unless given by another source
+			}
+			continue
+		}
+		if mg == nil {
+			mg = &Group{Vars: Vars{}}
+			i.Groups[name] = mg
+		}
+		mg.Connection.merge(o.resolveKey(g.Connection))
+		mg.Vars.merge(g.Vars)
+		for _, h := range g.Hosts {
+			if !contains(mg.Hosts, h) {
+				mg.Hosts = append(mg.Hosts, h)
+			}
+		}
+	}
+	for name, h := range o.Hosts {
+		mh, ok := i.Hosts[name]
+		if h == nil {
+			if !ok {
+				i.Hosts[name] = nil // rejected by validation unless given by another source
+			}
+			continue
+		}
+		if mh == nil {
+			mh = &Host{Vars: Vars{}}
+			i.Hosts[name] = mh
+		}
+		mh.Connection.merge(o.resolveKey(h.Connection))
+		mh.Vars.merge(h.Vars)
+		if h.Address != "" {
+			mh.Address = h.Address
+		}
+	}
+}
+
+// Make relative key paths absolute, as the inventory's directory is lost when
+// it is cached.
+func (i *Inventory) resolveKeys() {
+	i.Connection = i.resolveKey(i.Connection)
+	for _, g := range i.Groups {
+		if g != nil {
+			g.Connection = i.resolveKey(g.Connection)
+		}
+	}
+	for _, h := range i.Hosts {
+		if h != nil {
+			h.Connection = i.resolveKey(h.Connection)
+		}
+	}
+	i.dir = ""
+}
+
+// Returns the given connection settings with the key path made absolute
+// relative to the inventory's directory.
+func (i *Inventory) resolveKey(c Connection) Connection {
+	if i.dir != "" && c.Key != "" && !filepath.IsAbs(c.Key) && !strings.HasPrefix(c.Key, "~/") {
+		if p, err := filepath.Abs(filepath.Join(i.dir, c.Key)); err == nil {
+			c.Key = p
+		}
+	}
+	return c
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+package inventory
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type countingSource struct {
+	inventory string
+	calls     int
+}
+
+func (c *countingSource) Inventory() (*Inventory, error) {
+	c.calls++
+	return Parse(strings.NewReader(c.inventory))
+}
+
+func TestExecSource(t *testing.T) {
+	src := &ExecSource{Path: "sh", Args: []string{"-c", `echo '{"hosts": {"web1": {"address": "'$ADDRESS'"}}}'`}, Env: []string{"ADDRESS=10.0.0.1"}}
+	i, err := src.Inventory()
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if h, err := i.Host("web1"); err != nil || h.Address != "10.0.0.1" {
+		t.Errorf("expected host web1 with address 10.0.0.1, got %v (%v)", h, err)
+	}
+
+	for _, src := range []*ExecSource{
+		{Path: "sh", Args: []string{"-c", "echo 'api down' >&2; exit 1"}},
+		{Path: "sh", Args: []string{"-c", "echo 'not json'"}},
+		{Path: "sh", Args: []string{"-c", "exec sleep 5"}, Timeout: 50 * time.Millisecond},
+	} {
+		if _, err := src.Inventory(); err == nil {
+			t.Errorf("expected %s to fail", src)
+		}
+	}
+}
+
+func TestCachedSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := &countingSource{inventory: testInventory}
+	c := Cached(src, filepath.Join(dir, "cache", "inventory.json"), time.Hour)
+	for j := 0; j < 2; j++ {
+		i, err := c.Inventory()
+		if err != nil {
+			t.Fatalf("didn't expect an error, got %q", err)
+		}
+		if h, err := i.Host("es2"); err != nil || h.Vars["heap_size"] != "8g" {
+			t.Errorf("expected cached inventory to contain es2, got %v (%v)", h, err)
+		}
+	}
+	if src.calls != 1 {
+		t.Errorf("expected source to be called once, got %d", src.calls)
+	}
+
+	c.TTL = 0
+	if _, err := c.Inventory(); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if src.calls != 2 {
+		t.Errorf("expected expired cache to call the source, got %d calls", src.calls)
+	}
+}
+
+func TestCachedSourceSkipsInvalidInventories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "inventory.json")
+	if err := ioutil.WriteFile(path, []byte(testInventory), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cache := filepath.Join(dir, "cache", "inventory.json")
+
+	for _, script := range []string{
+		"echo 'not json'",
+		`echo '{"groups": {"databases": {"hosts": ["db1"]}}}'`,
+	} {
+		c := Cached(&ExecSource{Path: "sh", Args: []string{"-c", script}}, cache, time.Hour)
+		if _, err := c.Inventory(); err == nil {
+			t.Errorf("expected %q to fail", script)
+		}
+		if _, err := os.Stat(cache); !os.IsNotExist(err) {
+			t.Errorf("expected invalid inventory of %q not to be cached, got %v", script, err)
+		}
+	}
+
+	// groups of hosts declared in the inventory file only
+	groups := Cached(&ExecSource{Path: "sh", Args: []string{"-c", `echo '{"groups": {"databases": {"hosts": ["db1"]}}}'`}}, cache, time.Hour)
+	if _, err := Merge(FileSource(path), groups).Inventory(); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if _, err := os.Stat(cache); err != nil {
+		t.Errorf("expected inventory to be cached once merged, got %v", err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "inventory.json")
+	if err := ioutil.WriteFile(path, []byte(testInventory), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmdb := &countingSource{inventory: `{
+	  "groups": { "elasticsearch": { "hosts": ["es3"] } },
+	  "hosts": {
+	    "es1": { "vars": { "rack": "r1" } },
+	    "es3": { "address": "10.0.0.3" }
+	  }
+	}`}
+	i, err := Merge(FileSource(path), cmdb).Inventory()
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	hosts, err := i.Select("elasticsearch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ex := names(hosts), "es1,es2,es3"; v != ex {
+		t.Errorf("expected merged group to contain %q, got %q", ex, v)
+	}
+	es1 := hosts[0]
+	if es1.Address != "10.0.0.1" || es1.Vars["rack"] != "r1" || es1.Vars["heap_size"] != "4g" {
+		t.Errorf("expected host es1 to be merged, got %#v", es1)
+	}
+	if h, _ := i.Host("db1"); h.Key != filepath.Join(dir, "keys/db") {
+		t.Errorf("expected key to be resolved relative to the inventory file, got %q", h.Key)
+	}
+
+	broken := &countingSource{inventory: `{"hosts": {"a": {}}, "groups": {"db": {"hosts": ["b"]}}}`}
+	if _, err := Merge(broken).Inventory(); err == nil {
+		t.Errorf("expected merging invalid inventory to fail")
+	}
+	failing := &ExecSource{Path: "false"}
+	if _, err := Merge(FileSource(path), failing).Inventory(); err == nil {
+		t.Errorf("expected merging a failing source to fail")
+	} else if !strings.Contains(err.Error(), fmt.Sprint(failing)) {
+		t.Errorf("expected error to name the failing source, got %q", err)
+	}
+}
+
+func TestMergeValidatesMergedInventory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "inventory.json")
+	if err := ioutil.WriteFile(path, []byte(testInventory), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// groups of hosts declared in the inventory file only
+	groups := &ExecSource{Path: "sh", Args: []string{"-c", `echo '{"groups": {"databases": {"hosts": ["db1"]}}}'`}}
+	if _, err := groups.Inventory(); err == nil {
+		t.Errorf("expected incomplete inventory to be invalid on its own")
+	}
+	i, err := Merge(FileSource(path), groups).Inventory()
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if hosts, err := i.Select("databases"); err != nil || names(hosts) != "db1" {
+		t.Errorf("expected group databases to contain db1, got %v (%v)", hosts, err)
+	}
+
+	nulls := &ExecSource{Path: "sh", Args: []string{"-c", `echo '{"hosts": {"db2": null}}'`}}
+	if _, err := Merge(FileSource(path), nulls).Inventory(); err == nil || !strings.Contains(err.Error(), `host "db2"`) {
+		t.Errorf("expected null host to be rejected, got %v", err)
+	}
+}
+
+func TestMergeKeepsSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "inventory.json")
+	if err := ioutil.WriteFile(path, []byte(testInventory), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := &Inventory{Vars: Vars{}, Groups: map[string]*Group{}, Hosts: map[string]*Host{}}
+	merged.merge(src)
+	if v := merged.Hosts["db1"].Key; v != filepath.Join(dir, "keys/db") {
+		t.Errorf("expected merged key to be resolved, got %q", v)
+	}
+	if v := src.Hosts["db1"].Key; v != "keys/db" {
+		t.Errorf("expected key of the source to be kept, got %q", v)
+	}
+	if src.dir != dir {
+		t.Errorf("expected directory of the source to be kept, got %q", src.dir)
+	}
+}
@@ -0,0 +1,168 @@
+package urknall
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dynport/urknall/utils"
+)
+
+// Locks older than this are considered stale, if the build doesn't set a
+// timeout.
+const defaultLockTimeout = 6 * time.Hour
+
+// Exit status of the lock scripts, if the host is locked by another build.
+const lockedExitStatus = 75
+
+// Error returned if the host is locked by another build.
+type LockedError struct {
+	Holder  string    // User and host that started the build holding the lock.
+	PID     int       // Process ID of the build holding the lock.
+	Started time.Time // Start of the build holding the lock.
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("host is locked by %s (pid %d) since %s", e.Holder, e.PID, e.Started.Format(time.RFC3339))
+}
+
+func (e *LockedError) content() string {
+	return fmt.Sprintf("holder=%s\npid=%d\nstarted=%s", e.Holder, e.PID, e.Started.Format(time.RFC3339))
+}
+
+func parseLock(in string) *LockedError {
+	l := &LockedError{}
+	scanner := bufio.NewScanner(strings.NewReader(in))
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "holder":
+			l.Holder = kv[1]
+		case "pid":
+			l.PID, _ = strconv.Atoi(kv[1])
+		case "started":
+			l.Started, _ = time.Parse(time.RFC3339, kv[1])
+		}
+	}
+	return l
+}
+
+// The state directory is created before (see prepareStateDirCmd).
+const lockAcquireCmd = `set -e
+cd /var/lib/urknall
+lock=$(head -n 3)
+if ( set -o noclobber; echo "$lock" > .lock ) 2> /dev/null; then
+  exit 0
+fi
+cat .lock
+exit 75
+`
+
+// Replaces the lock, if it still has the expected content (if given).
+const lockReplaceCmd = `set -e
+cd /var/lib/urknall
+lock=$(head -n 3)
+expected=%s
+if [[ -n $expected && "$(cat .lock 2> /dev/null)" != "$expected" ]]; then
+  cat .lock
+  exit 75
+fi
+tmp=$(mktemp .lock.XXXXXX)
+echo "$lock" > $tmp
+mv -f $tmp .lock
+`
+
+const lockReleaseCmd = `cd /var/lib/urknall 2> /dev/null || exit 0
+lock=$(head -n 3)
+if [[ "$(cat .lock 2> /dev/null)" == "$lock" ]]; then
+  rm -f .lock
+fi
+`
+
+// Remove the build lock from the given target, regardless of its holder.
+func ForceUnlock(target Target) error {
+	c, err := (&Build{Target: target}).prepareCommand("rm -f " + ukCACHEDIR + "/.lock")
+	if err != nil {
+		return err
+	}
+	return runCaptured(c)
+}
+
+// Run the given function while holding the host's build lock. Stale locks
+// (older than the build's lock timeout) are taken over, and existing locks
+// are ignored if the build forces unlocking.
+func (b *Build) withLock(f func() error) error {
+	host, _ := os.Hostname()
+	lock := &LockedError{Holder: currentOperator() + "@" + host, PID: os.Getpid(), Started: time.Now().UTC().Truncate(time.Second)}
+
+	c, err := b.prepareInternalCommand(prepareStateDirCmd)
+	if err != nil {
+		return err
+	}
+	if err := runCaptured(c); err != nil {
+		return fmt.Errorf("failed to create state directory: %s", err)
+	}
+
+	err = b.lockCommand(lockAcquireCmd, lock)
+	if locked, ok := err.(*LockedError); ok {
+		timeout := b.LockTimeout
+		if timeout == 0 {
+			timeout = defaultLockTimeout
+		}
+		switch {
+		case b.ForceUnlock:
+			err = b.lockCommand(fmt.Sprintf(lockReplaceCmd, `""`), lock)
+		case time.Since(locked.Started) > timeout:
+			fmt.Printf("%s taking over stale lock (%s)\n", b.Target.String(), locked)
+			err = b.lockCommand(fmt.Sprintf(lockReplaceCmd, utils.ShellQuote(locked.content())), lock)
+		}
+	}
+	if _, ok := err.(*LockedError); ok {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("failed to lock host: %s", err)
+	}
+	err = f()
+	if e := b.lockCommand(lockReleaseCmd, lock); e != nil {
+		e = fmt.Errorf("failed to release lock: %s", e)
+		if err != nil {
+			logError(e)
+			return err
+		}
+		return e
+	}
+	return err
+}
+
+// Run the given lock script with the lock's content on stdin. Returns a
+// LockedError if the host is locked by someone else. The scripts read the
+// content's three lines only, as stdin doesn't signal EOF if the command runs
+// in a PTY.
+func (b *Build) lockCommand(script string, lock *LockedError) error {
+	c, err := b.prepareCommand("bash -c " + utils.ShellQuote(script))
+	if err != nil {
+		return err
+	}
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	c.SetStdin(strings.NewReader(lock.content() + "\n"))
+	c.SetStdout(stdout)
+	c.SetStderr(stderr)
+	err = c.Run()
+	if err == nil {
+		return nil
+	}
+	if status, ok := exitStatus(err); ok && status == lockedExitStatus {
+		if l := parseLock(stdout.String()); l.Holder != "" {
+			return l
+		}
+	}
+	return fmt.Errorf("%s (stderr=%q)", err, stderr.String())
+}
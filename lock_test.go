@@ -0,0 +1,133 @@
+package urknall
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dynport/dgtk/confirm"
+	"github.com/dynport/urknall/urknalltest"
+)
+
+func writeLock(t *testing.T, stateDir string, l *LockedError) string {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(stateDir, ".lock")
+	if err := ioutil.WriteFile(p, []byte(l.content()+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLockHeldDuringRun(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+	p := filepath.Join(ft.StateDir(), ".lock")
+
+	var held *LockedError
+	b := &Build{Target: ft, Template: TemplateFunc(threeCommands), Confirm: func(actions ...*confirm.Action) error {
+		content, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		held = parseLock(string(content))
+		return callAll(actions...)
+	}}
+	if err := b.Run(); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if held == nil || held.PID != os.Getpid() || held.Holder == "" {
+		t.Errorf("expected lock of this process to be held during the run, got %#v", held)
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Errorf("expected lock to be released after the run")
+	}
+}
+
+func TestLockedHost(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+	other := &LockedError{Holder: "alice@laptop", PID: 42, Started: time.Now().UTC().Truncate(time.Second)}
+	p := writeLock(t, ft.StateDir(), other)
+
+	err := Run(ft, TemplateFunc(threeCommands))
+	locked, ok := err.(*LockedError)
+	if !ok {
+		t.Fatalf("expected a LockedError, got %#v", err)
+	}
+	if *locked != *other {
+		t.Errorf("expected holder to be %#v, got %#v", other, locked)
+	}
+	if v := ft.Executed(); len(v) != 0 {
+		t.Errorf("expected nothing to be executed, got %q", v)
+	}
+	if _, err := os.Stat(p); err != nil {
+		t.Errorf("expected lock of other build to be kept, got %q", err)
+	}
+
+	if err := Run(ft, TemplateFunc(threeCommands), func(b *Build) { b.ForceUnlock = true }); err != nil {
+		t.Fatalf("didn't expect an error when forcing, got %q", err)
+	}
+	if v := len(ft.Executed()); v != 3 {
+		t.Errorf("expected 3 commands to be executed, got %d", v)
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Errorf("expected lock to be released after the run")
+	}
+}
+
+func TestStaleLock(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+	writeLock(t, ft.StateDir(), &LockedError{Holder: "alice@laptop", PID: 42, Started: time.Now().Add(-2 * time.Hour)})
+
+	if err := Run(ft, TemplateFunc(threeCommands), func(b *Build) { b.LockTimeout = 3 * time.Hour }); err == nil {
+		t.Fatalf("expected lock within timeout to be respected")
+	}
+	if err := Run(ft, TemplateFunc(threeCommands), func(b *Build) { b.LockTimeout = time.Hour }); err != nil {
+		t.Fatalf("expected stale lock to be taken over, got %q", err)
+	}
+}
+
+func TestForceUnlock(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+	p := writeLock(t, ft.StateDir(), &LockedError{Holder: "alice@laptop", PID: 42, Started: time.Now()})
+
+	if err := ForceUnlock(ft); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Errorf("expected lock to be removed")
+	}
+}
+
+func TestLockPreparesStateDir(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+
+	if err := Run(ft, TemplateFunc(threeCommands)); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if c := ft.Commands(); len(c) == 0 || !strings.Contains(c[0], "mkdir -p -m 2775") {
+		t.Errorf("expected the state directory to be prepared before locking, got %q", c)
+	}
+}
+
+func TestLockReleaseError(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+
+	ft.Handle(`rm -f \.lock`, &urknalltest.Response{Stderr: "read-only file system", ExitStatus: 1})
+	err := Run(ft, TemplateFunc(threeCommands))
+	if err == nil || !strings.Contains(err.Error(), "failed to release lock") {
+		t.Errorf("expected release error to be reported, got %v", err)
+	}
+	if v := len(ft.Executed()); v != 3 {
+		t.Errorf("expected 3 commands to be executed, got %d", v)
+	}
+}
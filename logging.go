@@ -1,6 +1,7 @@
 package urknall
 
 import (
+	"log"
 	"time"
 
 	"github.com/dynport/urknall/pubsub"
@@ -9,3 +10,7 @@ import (
 func message(key string, hostname string, taskName string) (msg *pubsub.Message) {
 	return &pubsub.Message{Key: key, StartedAt: time.Now(), Hostname: hostname, TaskName: taskName}
 }
+
+func logError(e error) {
+	log.Printf("ERROR: %s", e.Error())
+}
@@ -0,0 +1,101 @@
+package urknall
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dynport/urknall/utils"
+)
+
+// A task renamed from one name to another (see Package.AddAlias).
+type Migration struct {
+	From string
+	To   string
+}
+
+// Find the tasks of the state, that must be migrated according to the aliases
+// of the package. The state is updated accordingly, i.e. it reflects the host
+// after the migrations were applied. Old names that are still rendered and
+// new names that have state already are not migrated.
+func migrateState(pkg *packageImpl, state map[string]*taskState) []*Migration {
+	rendered := map[string]struct{}{}
+	for _, t := range pkg.tasks {
+		rendered[t.name] = struct{}{}
+	}
+
+	names := []string{}
+	for name := range state {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	migrations := []*Migration{}
+	for _, a := range pkg.aliases {
+		for _, name := range names {
+			var to string
+			switch {
+			case name == a.From:
+				to = a.To
+			case strings.HasPrefix(name, a.From+"."):
+				to = a.To + strings.TrimPrefix(name, a.From)
+			default:
+				continue
+			}
+			if _, ok := state[name]; !ok {
+				continue // migrated already
+			}
+			if _, ok := rendered[name]; ok {
+				continue
+			}
+			if _, ok := rendered[to]; !ok {
+				continue
+			}
+			if _, ok := state[to]; ok {
+				continue
+			}
+			state[to] = state[name]
+			delete(state, name)
+			migrations = append(migrations, &Migration{From: name, To: to})
+		}
+	}
+	return migrations
+}
+
+// Escape the given string for usage in a basic sed regular expression.
+func sedEscape(s string) string {
+	for _, c := range []string{`\`, ".", "[", "]", "*", "^", "$", "#"} {
+		s = strings.Replace(s, c, `\`+c, -1)
+	}
+	return s
+}
+
+// Escapes strings for usage in the replacement of a sed substitution.
+var sedReplacer = strings.NewReplacer(`\`, `\\`, "&", `\&`, "#", `\#`)
+
+// Move the state directory of the migrated task on the host, rewrite the
+// paths in its run files and record the migration in its history. A directory
+// of the new name left over by a failed build (it has no run file, otherwise
+// the task wouldn't be migrated) is merged into the migrated one, without
+// overwriting any of its files.
+func (b *Build) migrationAction(m *Migration) func() error {
+	return func() error {
+		fmt.Printf("%s migrating state from %s\n", b.logPrefix(m.To), m.From)
+		from, to := ukCACHEDIR+"/"+m.From, ukCACHEDIR+"/"+m.To
+		raw := strings.Join([]string{
+			"set -e",
+			fmt.Sprintf("if [ -e %[2]s ]; then cp -an %[2]s/. %[1]s/ && rm -rf %[2]s; fi", utils.ShellQuote(from), utils.ShellQuote(to)),
+			fmt.Sprintf("mv %s %s", utils.ShellQuote(from), utils.ShellQuote(to)),
+			fmt.Sprintf("sed -i %s %s/*.run", utils.ShellQuote(fmt.Sprintf("s#^%s/%s/#%s/%s/#", ukCACHEDIR, sedEscape(m.From), ukCACHEDIR, sedReplacer.Replace(m.To))), utils.ShellQuote(to)),
+			fmt.Sprintf(`echo "$(TZ=UTC date +%%Y%%m%%d_%%H%%M%%S) %s %s" >> %s/migrations.log`, m.From, m.To, utils.ShellQuote(to)),
+		}, "\n")
+		c, err := b.prepareCommand("bash -c " + utils.ShellQuote(raw))
+		if err != nil {
+			return err
+		}
+		if err := runCaptured(c); err != nil {
+			return fmt.Errorf("failed to migrate state from %s to %s: %s", m.From, m.To, err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,124 @@
+package urknall
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTaskAliases(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+
+	before := TemplateFunc(func(p Package) {
+		p.AddCommands("base", Shell("echo base"))
+		p.AddTemplate("ruby", TemplateFunc(func(p Package) {
+			p.AddCommands("install", Shell("echo ruby"), Shell("echo gems"))
+		}))
+	})
+	after := TemplateFunc(func(p Package) {
+		p.AddCommands("base", Shell("echo base"))
+		p.AddTemplate("staging", TemplateFunc(func(p Package) {
+			p.AddAlias("ruby", "ruby-2.1")
+			p.AddTemplate("ruby-2.1", TemplateFunc(func(p Package) {
+				p.AddCommands("install", Shell("echo ruby"), Shell("echo gems"), Shell("echo bundler"))
+			}))
+		}))
+	})
+
+	if err := Run(ft, before); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	b := &Build{Target: ft, Template: after}
+	if err := b.Run(); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := strings.Join(ft.Executed(), ","), "echo base,echo ruby,echo gems,echo bundler"; v != ex {
+		t.Errorf("expected executed commands to be %q, got %q", ex, v)
+	}
+	if m := b.Result().Migrations; len(m) != 1 || m[0].From != "ruby.install" || m[0].To != "staging.ruby-2.1.install" {
+		t.Errorf("expected a single migration, got %+v", m)
+	}
+	if o := b.Result().Orphans; len(o) != 0 {
+		t.Errorf("expected no orphans after migration, got %q", o)
+	}
+
+	state, err := ft.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state["ruby.install"]; ok {
+		t.Errorf("expected old state to be moved")
+	}
+	if v := state["staging.ruby-2.1.install"]; len(v) != 3 {
+		t.Errorf("expected 3 checksums in migrated state, got %q", v)
+	}
+	log, err := ioutil.ReadFile(filepath.Join(ft.StateDir(), "staging.ruby-2.1.install", "migrations.log"))
+	if err != nil || !strings.Contains(string(log), " ruby.install staging.ruby-2.1.install") {
+		t.Errorf("expected migration to be recorded, got %q (%v)", log, err)
+	}
+
+	if err := Run(ft, after); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v := len(ft.Executed()); v != 4 {
+		t.Errorf("expected nothing to be executed after migration, got %q", ft.Executed()[4:])
+	}
+}
+
+func TestTaskAliasesWithLeftoverState(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+
+	before := TemplateFunc(func(p Package) {
+		p.AddCommands("ruby", Shell("echo ruby"))
+	})
+	after := TemplateFunc(func(p Package) {
+		p.AddAlias("ruby", "ruby-2.1")
+		p.AddCommands("ruby-2.1", Shell("echo ruby"), Shell("echo gems"))
+	})
+
+	if err := Run(ft, before); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	// a build of the new name failed before writing a run file
+	leftover := filepath.Join(ft.StateDir(), "ruby-2.1", "build.20140101_000000")
+	if err := os.MkdirAll(leftover, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(leftover, "failed.log"), []byte("failed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Build{Target: ft, Template: after}
+	if err := b.Run(); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if m := b.Result().Migrations; len(m) != 1 || m[0].From != "ruby" || m[0].To != "ruby-2.1" {
+		t.Errorf("expected a single migration, got %+v", m)
+	}
+	if v, ex := strings.Join(ft.Executed(), ","), "echo ruby,echo gems"; v != ex {
+		t.Errorf("expected executed commands to be %q, got %q", ex, v)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(leftover, "failed.log")); err != nil || string(b) != "failed" {
+		t.Errorf("expected leftover state to be merged, got %q (%v)", b, err)
+	}
+	state, err := ft.State()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state["ruby"]; ok {
+		t.Errorf("expected old state to be moved")
+	}
+	if v := state["ruby-2.1"]; len(v) != 2 {
+		t.Errorf("expected 2 checksums in migrated state, got %q", v)
+	}
+}
+
+func TestSedEscape(t *testing.T) {
+	if v, ex := sedEscape("ruby-2.1.*"), `ruby-2\.1\.\*`; v != ex {
+		t.Errorf("expected %q, got %q", ex, v)
+	}
+}
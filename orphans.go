@@ -0,0 +1,138 @@
+package urknall
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dynport/dgtk/confirm"
+	"github.com/dynport/gocli"
+	"github.com/dynport/urknall/cmd"
+	"github.com/dynport/urknall/pubsub"
+
+	"github.com/dynport/urknall/utils"
+)
+
+func teardownScript(cmds []cmd.Command) string {
+	lines := []string{"set -e"}
+	for _, c := range cmds {
+		lines = append(lines, c.Shell())
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Add the actions required to keep the teardown scripts on the host up to
+// date, and to tear down orphaned tasks (if the build prunes orphans). The
+// orphans are added to the build's result.
+func (b *Build) teardownActions(pkg *packageImpl, state map[string]*taskState, actions *confirm.Actions) error {
+	rendered := map[string]struct{}{}
+	for _, t := range pkg.tasks {
+		rendered[t.name] = struct{}{}
+	}
+	for name := range pkg.teardowns {
+		if _, ok := rendered[name]; !ok {
+			return fmt.Errorf("teardown registered for unknown task %q", name)
+		}
+	}
+
+	for _, t := range pkg.tasks {
+		var stored *string
+		if s, ok := state[t.name]; ok {
+			stored = s.teardown
+		}
+		cmds, ok := pkg.teardowns[t.name]
+		switch {
+		case ok && (stored == nil || *stored != teardownScript(cmds)):
+			script := teardownScript(cmds)
+			actions.Create(t.name+" (store teardown)", []byte(script), b.storeTeardownAction(t.name, script))
+		case !ok && stored != nil:
+			actions.Create(t.name+" (remove teardown)", nil, b.storeTeardownAction(t.name, ""))
+		}
+	}
+
+	orphans := []string{}
+	for name := range state {
+		if _, ok := rendered[name]; !ok {
+			orphans = append(orphans, name)
+		}
+	}
+	sort.Strings(orphans)
+	b.result.Orphans = orphans
+	if !b.Prune {
+		return nil
+	}
+	for i := len(orphans) - 1; i >= 0; i-- {
+		name := orphans[i]
+		if len(name) > b.maxLength {
+			b.maxLength = len(name)
+		}
+		if s := state[name].teardown; s != nil {
+			actions.Create(name+" (orphaned, teardown)", []byte(*s), b.pruneAction(name, true))
+		} else {
+			actions.Create(name+" (orphaned, remove state)", nil, b.pruneAction(name, false))
+		}
+	}
+	return nil
+}
+
+// Write the teardown script of the given task to the host (or remove it if
+// empty).
+func (b *Build) storeTeardownAction(name, script string) func() error {
+	return func() error {
+		dir := utils.ShellQuote(ukCACHEDIR + "/" + name)
+		raw := fmt.Sprintf("rm -f %s/teardown.sh", dir)
+		if script != "" {
+			raw = fmt.Sprintf("mkdir -p %[1]s && cat > %[1]s/teardown.sh", dir)
+		}
+		c, err := b.prepareCommandWithStdin("bash -c " + utils.ShellQuote(raw))
+		if err != nil {
+			return err
+		}
+		c.SetStdin(strings.NewReader(script))
+		return runCaptured(c)
+	}
+}
+
+// Run the teardown script of the orphaned task (if it has one) and remove
+// its state.
+func (b *Build) pruneAction(name string, teardown bool) func() error {
+	return func() error {
+		prefix := b.logPrefix(name)
+		dir := utils.ShellQuote(ukCACHEDIR + "/" + name)
+		raw := "rm -rf " + dir
+		if teardown {
+			fmt.Println(prefix + " tearing down orphaned task")
+			raw = fmt.Sprintf("bash %s/teardown.sh < /dev/null && %s", dir, raw)
+		} else {
+			fmt.Println(prefix + " removing state of orphaned task")
+		}
+		c, err := b.prepareCommand("bash -c " + utils.ShellQuote(raw))
+		if err != nil {
+			return err
+		}
+		o, err := c.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		e, err := c.StderrPipe()
+		if err != nil {
+			return err
+		}
+		wg := &sync.WaitGroup{}
+		wg.Add(2)
+		go consumeStream(prefix, gocli.Red, e, wg)
+		go consumeStream(prefix, func(in string) string { return in }, o, wg)
+		if err := c.Start(); err != nil {
+			return err
+		}
+		wg.Wait()
+		if err := c.Wait(); err != nil {
+			return fmt.Errorf("failed to tear down orphaned task %s: %s", name, err)
+		}
+		m := message(pubsub.MessageCleanupCacheEntries, b.hostname(), name)
+		m.Message = "removed state of orphaned task"
+		m.Publish("finished")
+		return nil
+	}
+}
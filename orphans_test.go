@@ -0,0 +1,108 @@
+package urknall
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dynport/dgtk/confirm"
+)
+
+func TestOrphanedTasks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "urknall-orphans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	marker := filepath.Join(dir, "torn_down")
+
+	ft := newFakeTarget(t)
+	defer ft.Close()
+
+	withRedis := TemplateFunc(func(p Package) {
+		p.AddCommands("app", Shell("echo app"))
+		p.AddTemplate("redis", TemplateFunc(func(p Package) {
+			p.AddCommands("install", Shell("echo redis"))
+			p.AddTeardown("install", Shell("echo removed > "+marker))
+		}))
+	})
+	withoutRedis := TemplateFunc(func(p Package) {
+		p.AddCommands("app", Shell("echo app"))
+	})
+
+	if err := Run(ft, withRedis); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if _, err := os.Stat(filepath.Join(ft.StateDir(), "redis.install", "teardown.sh")); err != nil {
+		t.Fatalf("expected teardown script to be stored: %s", err)
+	}
+	names := []string{}
+	b := &Build{Target: ft, Template: withRedis, Confirm: func(actions ...*confirm.Action) error {
+		for _, a := range actions {
+			names = append(names, a.Key)
+		}
+		return nil
+	}}
+	if err := b.Run(); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if len(names) != 0 {
+		t.Errorf("expected no actions for unchanged template, got %q", names)
+	}
+
+	b = &Build{Target: ft, Template: withoutRedis}
+	if err := b.Run(); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := strings.Join(b.Result().Orphans, ","), "redis.install"; v != ex {
+		t.Errorf("expected orphans to be %q, got %q", ex, v)
+	}
+	if _, err := os.Stat(filepath.Join(ft.StateDir(), "redis.install")); err != nil {
+		t.Errorf("expected orphans to be kept without pruning: %s", err)
+	}
+
+	b = &Build{Target: ft, Template: withoutRedis, Prune: true}
+	if err := b.Run(); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if out, err := ioutil.ReadFile(marker); err != nil || string(out) != "removed\n" {
+		t.Errorf("expected teardown to be run, got %q (%v)", out, err)
+	}
+	if _, err := os.Stat(filepath.Join(ft.StateDir(), "redis.install")); !os.IsNotExist(err) {
+		t.Errorf("expected state of orphan to be removed, got %v", err)
+	}
+
+	b = &Build{Target: ft, Template: withoutRedis}
+	if err := b.Run(); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if len(b.Result().Orphans) != 0 {
+		t.Errorf("expected no orphans after pruning, got %q", b.Result().Orphans)
+	}
+}
+
+func TestTeardownForUnknownTask(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+
+	err := Run(ft, TemplateFunc(func(p Package) {
+		p.AddCommands("app", Shell("echo app"))
+		p.AddTeardown("ap", Shell("echo removed"))
+	}))
+	if err == nil || !strings.Contains(err.Error(), `unknown task "ap"`) {
+		t.Errorf("expected error for teardown of unknown task, got %v", err)
+	}
+}
+
+func TestStoreTeardownWithoutPty(t *testing.T) {
+	tgt := &ptyTargetStub{}
+	b := &Build{Target: tgt}
+	if err := b.storeTeardownAction("app", "echo removed")(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.commands) != 1 || tgt.commands[0].requested {
+		t.Errorf("didn't expect PTY to be requested for storing the teardown script")
+	}
+}
@@ -22,4 +22,15 @@ type Package interface {
 	AddTemplate(string, Template)       // Add another template, nested below the current one.
 	AddCommands(string, ...cmd.Command) // Add a new task from the given commands.
 	AddTask(string, Task)               // Add the given tasks to the package with the given name.
+
+	// Register commands that undo the task with the given name (relative to
+	// the package like for the Add methods). They are run if the task is
+	// orphaned, i.e. no longer rendered, and the build prunes orphans.
+	AddTeardown(string, ...cmd.Command)
+
+	// Declare that the task with the given name (relative to the package)
+	// was formerly known by the first (absolute) name. The state of the old
+	// task (and of all tasks nested below it) is moved on the host, so that
+	// renamed tasks don't need to be executed again.
+	AddAlias(string, string)
 }
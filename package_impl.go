@@ -13,6 +13,13 @@ type packageImpl struct {
 	taskNames      map[string]struct{}
 	reference      interface{} // used for rendering
 	cacheKeyPrefix string
+	facts          *Facts
+	teardowns      map[string][]cmd.Command // teardown commands by task name
+	aliases        []*Migration             // former names of tasks
+}
+
+func (pkg *packageImpl) Facts() *Facts {
+	return pkg.facts
 }
 
 func (pkg *packageImpl) AddCommands(name string, cmds ...cmd.Command) {
@@ -35,6 +42,7 @@ func (pkg *packageImpl) AddTemplate(name string, tpl Template) {
 		name = pkg.cacheKeyPrefix + "." + name
 	}
 	name = utils.MustRenderTemplate(name, pkg.reference)
+	tpl = withFacts(tpl, pkg.facts)
 	e := validateTemplate(tpl)
 	if e != nil {
 		panic(e)
@@ -43,11 +51,55 @@ func (pkg *packageImpl) AddTemplate(name string, tpl Template) {
 		name = utils.MustRenderTemplate(name, pkg.reference)
 	}
 	pkg.validateTaskName(name)
-	child := &packageImpl{cacheKeyPrefix: name, reference: tpl}
+	child := &packageImpl{cacheKeyPrefix: name, reference: tpl, facts: pkg.facts}
 	tpl.Render(child)
 	for _, task := range child.tasks {
 		pkg.addTask(task)
 	}
+	for name, cmds := range child.teardowns {
+		pkg.addTeardown(name, cmds)
+	}
+	pkg.aliases = append(pkg.aliases, child.aliases...)
+}
+
+func (pkg *packageImpl) AddAlias(oldName, name string) {
+	if pkg.cacheKeyPrefix != "" {
+		name = pkg.cacheKeyPrefix + "." + name
+	}
+	name = utils.MustRenderTemplate(name, pkg.reference)
+	oldName = utils.MustRenderTemplate(oldName, pkg.reference)
+	if oldName == "" || strings.Contains(oldName, " ") {
+		panic(fmt.Sprintf("invalid alias %q for task %q", oldName, name))
+	}
+	pkg.aliases = append(pkg.aliases, &Migration{From: oldName, To: name})
+}
+
+func (pkg *packageImpl) AddTeardown(name string, cmds ...cmd.Command) {
+	if pkg.cacheKeyPrefix != "" {
+		name = pkg.cacheKeyPrefix + "." + name
+	}
+	name = utils.MustRenderTemplate(name, pkg.reference)
+	for _, c := range cmds {
+		if r, ok := c.(cmd.Renderer); ok {
+			r.Render(pkg.reference)
+		}
+		if v, ok := c.(cmd.Validator); ok {
+			if e := v.Validate(); e != nil {
+				panic(e)
+			}
+		}
+	}
+	pkg.addTeardown(name, cmds)
+}
+
+func (pkg *packageImpl) addTeardown(name string, cmds []cmd.Command) {
+	if pkg.teardowns == nil {
+		pkg.teardowns = map[string][]cmd.Command{}
+	}
+	if _, ok := pkg.teardowns[name]; ok {
+		panic(fmt.Sprintf("teardown for task %q exists already", name))
+	}
+	pkg.teardowns[name] = cmds
 }
 
 func (pkg *packageImpl) AddTask(name string, tsk Task) {
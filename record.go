@@ -0,0 +1,436 @@
+package urknall
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/dynport/urknall/target"
+)
+
+// Header of a transcript.
+type transcriptHeader struct {
+	Host    string `json:"host"`
+	User    string `json:"user"`
+	Uploads bool   `json:"uploads,omitempty"` // whether the target supports uploads
+}
+
+// An entry of a transcript, i.e. a command sent to the target (or a file
+// uploaded) and its result.
+type transcriptEntry struct {
+	Command    string                `json:"command,omitempty"`
+	Upload     string                `json:"upload,omitempty"` // path of an uploaded file (with the content as stdin)
+	Options    *target.UploadOptions `json:"upload_options,omitempty"`
+	Stdin      []byte                `json:"stdin,omitempty"`
+	Stdout     []byte                `json:"stdout,omitempty"`
+	Stderr     []byte                `json:"stderr,omitempty"`
+	ExitStatus int                   `json:"exit_status,omitempty"`
+	Error      string                `json:"error,omitempty"` // error message for failed commands
+}
+
+// A RecordingTarget wraps a target and writes a transcript of all commands,
+// with their stdin, stdout, stderr and exit status, and of all uploads. The
+// transcript can be used with a ReplayTarget to repeat a build without the
+// host, turning an incident into a regression test for a template for example.
+type RecordingTarget struct {
+	Target
+
+	mutex   sync.Mutex
+	enc     *json.Encoder
+	err     error
+	pending sync.WaitGroup
+}
+
+// Record the commands sent to the given target to w (as JSON lines). The
+// recording target must be closed to make sure all entries were written.
+func NewRecordingTarget(t Target, w io.Writer) (*RecordingTarget, error) {
+	rt := &RecordingTarget{Target: t, enc: json.NewEncoder(w)}
+	_, uploads := t.(target.Uploader)
+	if err := rt.enc.Encode(&transcriptHeader{Host: t.String(), User: t.User(), Uploads: uploads}); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// The returned command implements the optional interfaces of the wrapped
+// target's commands.
+func (rt *RecordingTarget) Command(cmd string) (target.ExecCommand, error) {
+	c, err := rt.Target.Command(cmd)
+	if err != nil {
+		return nil, err
+	}
+	tc := newTappedCommand(c, func(tc *tappedCommand, err error) {
+		defer rt.pending.Done()
+		e := &transcriptEntry{Command: cmd, Stdin: tc.stdin.Bytes(), Stdout: tc.stdout.Bytes(), Stderr: tc.stderr.Bytes()}
+		if err != nil {
+			e.Error = err.Error()
+			e.ExitStatus, _ = exitStatus(err)
+		}
+		rt.record(e)
+	})
+	tc.start = func() { rt.pending.Add(1) }
+	return withOptionalInterfaces(tc, c), nil
+}
+
+// Upload the file using the wrapped target and record the upload. Returns
+// errUploadsUnsupported if the wrapped target can't upload files.
+func (rt *RecordingTarget) Upload(r io.Reader, path string, opts *target.UploadOptions) error {
+	u, ok := rt.Target.(target.Uploader)
+	if !ok {
+		return errUploadsUnsupported
+	}
+	content := &bytes.Buffer{}
+	err := u.Upload(io.TeeReader(r, content), path, opts)
+	e := &transcriptEntry{Upload: path, Options: opts, Stdin: content.Bytes()}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	rt.pending.Add(1)
+	defer rt.pending.Done()
+	rt.record(e)
+	return err
+}
+
+func (rt *RecordingTarget) record(e *transcriptEntry) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	if err := rt.enc.Encode(e); err != nil && rt.err == nil {
+		rt.err = err
+	}
+}
+
+// Wait for all pending entries to be written. Commands that were never run
+// are not waited for.
+func (rt *RecordingTarget) Close() error {
+	rt.pending.Wait()
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	return rt.err
+}
+
+// A tappedCommand wraps an exec command and captures its streams. The done
+// function is called once the command finished and its output was consumed.
+type tappedCommand struct {
+	target.ExecCommand
+
+	stdin, stdout, stderr bytes.Buffer
+
+	streams sync.WaitGroup
+	once    sync.Once
+	started bool
+	start   func() // called when the command is started (if set)
+	done    func(*tappedCommand, error)
+}
+
+func newTappedCommand(c target.ExecCommand, done func(*tappedCommand, error)) *tappedCommand {
+	return &tappedCommand{ExecCommand: c, done: done}
+}
+
+func (c *tappedCommand) StdoutPipe() (io.Reader, error) {
+	r, err := c.ExecCommand.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	return c.tapReader(r, &c.stdout), nil
+}
+
+func (c *tappedCommand) StderrPipe() (io.Reader, error) {
+	r, err := c.ExecCommand.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	return c.tapReader(r, &c.stderr), nil
+}
+
+func (c *tappedCommand) StdinPipe() (io.WriteCloser, error) {
+	w, err := c.ExecCommand.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	return &tappedWriter{WriteCloser: w, tap: &c.stdin}, nil
+}
+
+func (c *tappedCommand) SetStdout(w io.Writer) {
+	c.ExecCommand.SetStdout(io.MultiWriter(w, &c.stdout))
+}
+
+func (c *tappedCommand) SetStderr(w io.Writer) {
+	c.ExecCommand.SetStderr(io.MultiWriter(w, &c.stderr))
+}
+
+func (c *tappedCommand) SetStdin(r io.Reader) {
+	c.ExecCommand.SetStdin(io.TeeReader(r, &c.stdin))
+}
+
+func (c *tappedCommand) Run() error {
+	c.begin()
+	err := c.ExecCommand.Run()
+	c.finish(err)
+	return err
+}
+
+func (c *tappedCommand) Start() error {
+	c.begin()
+	err := c.ExecCommand.Start()
+	if err != nil {
+		c.finish(err)
+	}
+	return err
+}
+
+func (c *tappedCommand) Wait() error {
+	err := c.ExecCommand.Wait()
+	c.finish(err)
+	return err
+}
+
+func (c *tappedCommand) begin() {
+	c.started = true
+	if c.start != nil {
+		c.start()
+	}
+}
+
+// Call the done function (once) after all tapped pipes were drained.
+func (c *tappedCommand) finish(err error) {
+	c.once.Do(func() {
+		go func() {
+			c.streams.Wait()
+			c.done(c, err)
+		}()
+	})
+}
+
+func (c *tappedCommand) tapReader(r io.Reader, tap *bytes.Buffer) io.Reader {
+	c.streams.Add(1)
+	return &tappedReader{reader: io.TeeReader(r, tap), done: c.streams.Done}
+}
+
+type tappedReader struct {
+	reader io.Reader
+	once   sync.Once
+	done   func()
+}
+
+func (r *tappedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil {
+		r.once.Do(r.done)
+	}
+	return n, err
+}
+
+type tappedWriter struct {
+	io.WriteCloser
+	tap *bytes.Buffer
+}
+
+func (w *tappedWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.tap.Write(p[:n])
+	return n, err
+}
+
+// A ReplayTarget answers commands from a transcript written by a
+// RecordingTarget. Each command must be found in the transcript (commands are
+// matched in order of their occurrence), otherwise an error is returned.
+type ReplayTarget struct {
+	header  *transcriptHeader
+	mutex   sync.Mutex
+	entries []*transcriptEntry
+	used    []bool
+}
+
+// Load the transcript from the given reader.
+func NewReplayTarget(r io.Reader) (*ReplayTarget, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	rt := &ReplayTarget{header: &transcriptHeader{}}
+	if err := dec.Decode(rt.header); err != nil {
+		return nil, fmt.Errorf("failed to read transcript header: %s", err)
+	}
+	for {
+		e := &transcriptEntry{}
+		switch err := dec.Decode(e); err {
+		case io.EOF:
+			rt.used = make([]bool, len(rt.entries))
+			return rt, nil
+		case nil:
+			rt.entries = append(rt.entries, e)
+		default:
+			return nil, fmt.Errorf("failed to read transcript entry %d: %s", len(rt.entries)+1, err)
+		}
+	}
+}
+
+func (rt *ReplayTarget) String() string {
+	return rt.header.Host
+}
+
+func (rt *ReplayTarget) User() string {
+	return rt.header.User
+}
+
+func (rt *ReplayTarget) Reset() error {
+	return nil
+}
+
+func (rt *ReplayTarget) Command(cmd string) (target.ExecCommand, error) {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	for i, e := range rt.entries {
+		if !rt.used[i] && e.Upload == "" && e.Command == cmd {
+			rt.used[i] = true
+			return &replayCommand{entry: e}, nil
+		}
+	}
+	return nil, fmt.Errorf("command not found in transcript: %q", cmd)
+}
+
+// Replay an upload, that must have been recorded with the same content.
+// Returns errUploadsUnsupported if the recorded target couldn't upload files.
+func (rt *ReplayTarget) Upload(r io.Reader, path string, opts *target.UploadOptions) error {
+	if !rt.header.Uploads {
+		return errUploadsUnsupported
+	}
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	for i, e := range rt.entries {
+		if !rt.used[i] && e.Upload == path && bytes.Equal(e.Stdin, content) {
+			rt.used[i] = true
+			if e.Error != "" {
+				return &replayError{msg: e.Error}
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("upload of %q not found in transcript", path)
+}
+
+// Number of transcript entries not replayed yet.
+func (rt *ReplayTarget) Remaining() int {
+	rt.mutex.Lock()
+	defer rt.mutex.Unlock()
+	cnt := 0
+	for _, u := range rt.used {
+		if !u {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// Error returned for replayed commands that failed.
+type replayError struct {
+	status int
+	msg    string
+}
+
+func (e *replayError) Error() string {
+	return e.msg
+}
+
+func (e *replayError) ExitStatus() int {
+	return e.status
+}
+
+type replayCommand struct {
+	entry *transcriptEntry
+
+	stdout, stderr io.Writer
+	stdin          io.Reader
+	closers        []io.Closer
+	done           chan struct{}
+}
+
+// Replayed commands accept agent forwarding, as recorded commands requiring it
+// only ran if the target supported it.
+func (c *replayCommand) ForwardAgent() error {
+	return nil
+}
+
+// Replayed commands accept PTY requests for the same reason.
+func (c *replayCommand) RequestPty() error {
+	return nil
+}
+
+func (c *replayCommand) PtyEnabled() bool {
+	return false
+}
+
+func (c *replayCommand) StdoutPipe() (io.Reader, error) {
+	r, w := io.Pipe()
+	c.stdout = w
+	c.closers = append(c.closers, w)
+	return r, nil
+}
+
+func (c *replayCommand) StderrPipe() (io.Reader, error) {
+	r, w := io.Pipe()
+	c.stderr = w
+	c.closers = append(c.closers, w)
+	return r, nil
+}
+
+func (c *replayCommand) StdinPipe() (io.WriteCloser, error) {
+	r, w := io.Pipe()
+	c.stdin = r
+	return w, nil
+}
+
+func (c *replayCommand) SetStdout(w io.Writer) {
+	c.stdout = w
+}
+
+func (c *replayCommand) SetStderr(w io.Writer) {
+	c.stderr = w
+}
+
+func (c *replayCommand) SetStdin(r io.Reader) {
+	c.stdin = r
+}
+
+func (c *replayCommand) Run() error {
+	if err := c.Start(); err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+func (c *replayCommand) Start() error {
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		if c.stdin != nil {
+			io.Copy(ioutil.Discard, c.stdin)
+		}
+		if c.stdout != nil {
+			c.stdout.Write(c.entry.Stdout)
+		}
+		if c.stderr != nil {
+			c.stderr.Write(c.entry.Stderr)
+		}
+		for _, cl := range c.closers {
+			cl.Close()
+		}
+	}()
+	return nil
+}
+
+func (c *replayCommand) Wait() error {
+	if c.done == nil {
+		return fmt.Errorf("command not started")
+	}
+	<-c.done
+	if c.entry.Error != "" {
+		return &replayError{status: c.entry.ExitStatus, msg: c.entry.Error}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package urknall
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dynport/urknall/target"
+	"github.com/dynport/urknall/urknalltest"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+
+	ft.Handle("^echo 2$", &urknalltest.Response{Stderr: "failed", ExitStatus: 1})
+	transcript := &bytes.Buffer{}
+	rt, err := NewRecordingTarget(ft, transcript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recErr := Run(rt, TemplateFunc(threeCommands))
+	if recErr == nil {
+		t.Fatalf("expected an error, got none")
+	}
+	if err := rt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if v, ex := len(strings.Split(strings.TrimSpace(transcript.String()), "\n")), len(ft.Commands())+1; v != ex {
+		t.Errorf("expected %d transcript lines, got %d", ex, v)
+	}
+
+	replay, err := NewReplayTarget(bytes.NewReader(transcript.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replay.String() != ft.String() || replay.User() != ft.User() {
+		t.Errorf("expected replay target to be %s@%s, got %s@%s", ft.User(), ft.String(), replay.User(), replay.String())
+	}
+	err = Run(replay, TemplateFunc(threeCommands))
+	if err == nil || err.Error() != recErr.Error() {
+		t.Errorf("expected replayed build to fail with %q, got %v", recErr, err)
+	}
+	if replay.Remaining() != 0 {
+		t.Errorf("expected all entries to be replayed, %d left", replay.Remaining())
+	}
+
+	replay, err = NewReplayTarget(bytes.NewReader(transcript.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Run(replay, TemplateFunc(func(p Package) { p.AddCommands("base", Shell("echo 4")) }))
+	if err == nil || !strings.Contains(err.Error(), "command not found in transcript") {
+		t.Errorf("expected unknown commands to fail, got %v", err)
+	}
+}
+
+func TestRecordingTargetPendingCommands(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+	rt, err := NewRecordingTarget(ft, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.Command("echo never run"); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- rt.Close() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("didn't expect an error, got %q", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected close not to wait for commands never run")
+	}
+}
+
+func TestRecordingTargetOptionalInterfaces(t *testing.T) {
+	rt, err := NewRecordingTarget(&ptyTargetStub{}, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := rt.Command("true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.(target.PtyRequester); !ok {
+		t.Errorf("expected recorded command to support PTYs")
+	}
+	if _, ok := c.(target.AgentForwarder); ok {
+		t.Errorf("didn't expect recorded command to support agent forwarding")
+	}
+}
+
+// A fake target with commands accepting PTY requests.
+type ptyFakeTarget struct {
+	*urknalltest.Target
+}
+
+func (t *ptyFakeTarget) Command(cmd string) (target.ExecCommand, error) {
+	c, err := t.Target.Command(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return &ptyFakeCommand{ExecCommand: c}, nil
+}
+
+type ptyFakeCommand struct {
+	target.ExecCommand
+}
+
+func (c *ptyFakeCommand) RequestPty() error { return nil }
+func (c *ptyFakeCommand) PtyEnabled() bool  { return false }
+
+func TestRecordAndReplayTerminalCommands(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+
+	tpl := TemplateFunc(func(p Package) {
+		p.AddCommands("base", &terminalCommand{testCommand{cmd: "echo 1"}})
+	})
+	transcript := &bytes.Buffer{}
+	rt, err := NewRecordingTarget(&ptyFakeTarget{Target: ft}, transcript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Run(rt, tpl); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if err := rt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	replay, err := NewReplayTarget(bytes.NewReader(transcript.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Run(replay, tpl); err != nil {
+		t.Errorf("didn't expect an error, got %q", err)
+	}
+	if replay.Remaining() != 0 {
+		t.Errorf("expected all entries to be replayed, %d left", replay.Remaining())
+	}
+}
+
+type uploadTargetStub struct {
+	*urknalltest.Target
+	uploads map[string]string
+}
+
+func (t *uploadTargetStub) Upload(r io.Reader, path string, opts *target.UploadOptions) error {
+	b, err := ioutil.ReadAll(r)
+	t.uploads[path] = string(b)
+	return err
+}
+
+func TestRecordAndReplayUploads(t *testing.T) {
+	ft := newFakeTarget(t)
+	defer ft.Close()
+	transcript := &bytes.Buffer{}
+	rt, err := NewRecordingTarget(&uploadTargetStub{Target: ft, uploads: map[string]string{}}, transcript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Upload(strings.NewReader("content"), "/etc/app.conf", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	replay, err := NewReplayTarget(bytes.NewReader(transcript.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replay.Upload(strings.NewReader("other"), "/etc/app.conf", nil); err == nil {
+		t.Errorf("expected uploads with other content to fail, got no error")
+	}
+	if err := replay.Upload(strings.NewReader("content"), "/etc/app.conf", nil); err != nil {
+		t.Errorf("didn't expect an error, got %q", err)
+	}
+	if replay.Remaining() != 0 {
+		t.Errorf("expected all entries to be replayed, %d left", replay.Remaining())
+	}
+
+	rt, err = NewRecordingTarget(ft, transcript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Upload(strings.NewReader("content"), "/etc/app.conf", nil); err != errUploadsUnsupported {
+		t.Errorf("expected uploads to targets without uploader to be unsupported, got %v", err)
+	}
+}
@@ -0,0 +1,386 @@
+package urknall
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	registryMutex sync.Mutex
+	registry      = map[string]Template{}
+)
+
+// Register the given template under the given name, so that it can be
+// instantiated by name (see NewTemplate), e.g. from declarative build specs.
+// The template must be a pointer to a struct; instances are created as
+// (shallow) copies of it, i.e. fields set on the registered value act as
+// defaults. Registering a name twice panics.
+func RegisterTemplate(name string, tpl Template) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	v := reflect.ValueOf(tpl)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("urknall: template %q must be a pointer to a struct, got %T", name, tpl))
+	}
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("urknall: template %q registered twice", name))
+	}
+	registry[name] = tpl
+}
+
+// Returns the names of all registered templates, sorted.
+func RegisteredTemplates() []string {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	names := []string{}
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func registeredTemplate(name string) (Template, bool) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	tpl, ok := registry[name]
+	return tpl, ok
+}
+
+// Create an instance of the template registered with the given name, and set
+// its fields from the given values. See DecodeTemplate for how values are
+// decoded.
+func NewTemplate(name string, values map[string]interface{}) (Template, error) {
+	return newTemplate("", name, values)
+}
+
+func newTemplate(path, name string, values map[string]interface{}) (Template, error) {
+	proto, ok := registeredTemplate(name)
+	if !ok {
+		return nil, fmt.Errorf("template %q not registered", name)
+	}
+	// a shallow copy of the prototype, decoding doesn't modify the values it
+	// shares with it (see decodeValue)
+	v := reflect.New(reflect.TypeOf(proto).Elem())
+	v.Elem().Set(reflect.ValueOf(proto).Elem())
+	tpl := v.Interface().(Template)
+	if err := decodeTemplate(path, tpl, values); err != nil {
+		return nil, err
+	}
+	return tpl, nil
+}
+
+// Set the fields of the given template (a pointer to a struct) from the given
+// values, as e.g. read from JSON. Values are matched to the exported fields by
+// their json tag or their name (case insensitive). Unknown values and values
+// that don't match the field's type are rejected, with errors naming the path
+// of the offending value (like "Upstreams[1].Port"). Fields of the Template
+// interface type are set from objects of the form {"template": <registered
+// name>, "values": {...}}. Afterwards the template is validated, i.e. the
+// `urknall:"required/default/min/max/size"` tags are applied.
+func DecodeTemplate(tpl Template, values map[string]interface{}) error {
+	return decodeTemplate("", tpl, values)
+}
+
+func decodeTemplate(path string, tpl Template, values map[string]interface{}) error {
+	v := reflect.ValueOf(tpl)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("template must be a pointer to a struct, got %T", tpl)
+	}
+	if err := decodeStruct(path, v.Elem(), values); err != nil {
+		return err
+	}
+	if err := validateTemplate(tpl); err != nil {
+		if path != "" {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		return err
+	}
+	return nil
+}
+
+var (
+	templateType = reflect.TypeOf((*Template)(nil)).Elem()
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// A field of a template that can be set from values.
+type templateField struct {
+	name  string // json tag or field name
+	field reflect.StructField
+	index []int
+}
+
+// The exported fields of a struct type, including those of embedded structs
+// (fields of the outer struct taking precedence).
+func templateFields(t reflect.Type) []*templateField {
+	fields := []*templateField{}
+	seen := map[string]struct{}{}
+	embedded := []*templateField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		switch {
+		case f.Anonymous && f.Type.Kind() == reflect.Struct:
+			for _, ef := range templateFields(f.Type) {
+				ef.index = append([]int{i}, ef.index...)
+				embedded = append(embedded, ef)
+			}
+			continue
+		case f.PkgPath != "":
+			continue // unexported
+		}
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		seen[strings.ToLower(name)] = struct{}{}
+		fields = append(fields, &templateField{name: name, field: f, index: []int{i}})
+	}
+	for _, ef := range embedded {
+		if _, ok := seen[strings.ToLower(ef.name)]; !ok {
+			seen[strings.ToLower(ef.name)] = struct{}{}
+			fields = append(fields, ef)
+		}
+	}
+	return fields
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func decodeStruct(path string, v reflect.Value, values map[string]interface{}) error {
+	fields := map[string]reflect.Value{}
+	for _, f := range templateFields(v.Type()) {
+		fields[strings.ToLower(f.name)] = v.FieldByIndex(f.index)
+	}
+	keys := []string{}
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		f, ok := fields[strings.ToLower(k)]
+		if !ok {
+			return fmt.Errorf("%s: unknown field", joinPath(path, k))
+		}
+		if err := decodeValue(joinPath(path, k), f, values[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func typeMismatch(path string, t reflect.Type, value interface{}) error {
+	return fmt.Errorf("%s: expected %s, got %s", path, t, describeValue(value))
+}
+
+func describeValue(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return fmt.Sprintf("string %q", value)
+	case json.Number:
+		return "number " + value.String()
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	return fmt.Sprintf("%T %v", value, value)
+}
+
+func decodeValue(path string, v reflect.Value, value interface{}) error {
+	if value == nil {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	value = genericValue(value)
+	if v.Type() == templateType {
+		return decodeNestedTemplate(path, v, value)
+	}
+	if v.Type() == durationType {
+		s, ok := value.(string)
+		if !ok {
+			return typeMismatch(path, v.Type(), value)
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%s: invalid duration %q", path, s)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			return typeMismatch(path, v.Type(), value)
+		}
+		v.SetString(s)
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return typeMismatch(path, v.Type(), value)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		f, ok := toFloat(value)
+		if !ok || f != float64(int64(f)) || v.OverflowInt(int64(f)) {
+			return typeMismatch(path, v.Type(), value)
+		}
+		v.SetInt(int64(f))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		f, ok := toFloat(value)
+		if !ok || f < 0 || f != float64(uint64(f)) || v.OverflowUint(uint64(f)) {
+			return typeMismatch(path, v.Type(), value)
+		}
+		v.SetUint(uint64(f))
+	case reflect.Float32, reflect.Float64:
+		f, ok := toFloat(value)
+		if !ok {
+			return typeMismatch(path, v.Type(), value)
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if s, ok := value.(string); ok {
+				v.SetBytes([]byte(s))
+				return nil
+			}
+		}
+		list, ok := value.([]interface{})
+		if !ok {
+			return typeMismatch(path, v.Type(), value)
+		}
+		s := reflect.MakeSlice(v.Type(), len(list), len(list))
+		for i, e := range list {
+			if err := decodeValue(fmt.Sprintf("%s[%d]", path, i), s.Index(i), e); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Map:
+		m, ok := value.(map[string]interface{})
+		if !ok || v.Type().Key().Kind() != reflect.String {
+			return typeMismatch(path, v.Type(), value)
+		}
+		mv := reflect.MakeMap(v.Type())
+		for k, e := range m {
+			ev := reflect.New(v.Type().Elem()).Elem()
+			if err := decodeValue(fmt.Sprintf("%s[%q]", path, k), ev, e); err != nil {
+				return err
+			}
+			mv.SetMapIndex(reflect.ValueOf(k).Convert(v.Type().Key()), ev)
+		}
+		v.Set(mv)
+	case reflect.Struct:
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return typeMismatch(path, v.Type(), value)
+		}
+		return decodeStruct(path, v, m)
+	case reflect.Ptr:
+		// decode into a copy, as the pointer might be shared (e.g. with the
+		// prototype of a registered template)
+		p := reflect.New(v.Type().Elem())
+		if !v.IsNil() {
+			p.Elem().Set(v.Elem())
+		}
+		if err := decodeValue(path, p.Elem(), value); err != nil {
+			return err
+		}
+		v.Set(p)
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("%s: can't decode into %s", path, v.Type())
+		}
+		v.Set(reflect.ValueOf(value))
+	default:
+		return fmt.Errorf("%s: can't decode into %s", path, v.Type())
+	}
+	return nil
+}
+
+// Convert slices and maps given as Go values (like []string) into the
+// generic form used by encoding/json.
+func genericValue(value interface{}) interface{} {
+	rv := reflect.ValueOf(value)
+	switch {
+	case rv.Kind() == reflect.Slice && rv.Type() != reflect.TypeOf([]interface{}{}) && rv.Type().Elem().Kind() != reflect.Uint8:
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			list[i] = rv.Index(i).Interface()
+		}
+		return list
+	case rv.Kind() == reflect.Map && rv.Type().Key().Kind() == reflect.String && rv.Type() != reflect.TypeOf(map[string]interface{}{}):
+		m := map[string]interface{}{}
+		for _, k := range rv.MapKeys() {
+			m[k.String()] = rv.MapIndex(k).Interface()
+		}
+		return m
+	}
+	return value
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case json.Number:
+		f, err := value.Float64()
+		return f, err == nil
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+// Nested templates are given as {"template": <name>, "values": {...}}.
+func decodeNestedTemplate(path string, v reflect.Value, value interface{}) error {
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return typeMismatch(path, v.Type(), value)
+	}
+	name, values := "", map[string]interface{}{}
+	for k, e := range m {
+		var ok bool
+		switch k {
+		case "template":
+			name, ok = e.(string)
+		case "values":
+			values, ok = e.(map[string]interface{})
+		default:
+			return fmt.Errorf("%s.%s: unknown field", path, k)
+		}
+		if !ok {
+			return fmt.Errorf("%s.%s: expected %s, got %s", path, k, map[string]string{"template": "string", "values": "object"}[k], describeValue(e))
+		}
+	}
+	if _, ok := registeredTemplate(name); !ok {
+		return fmt.Errorf("%s.template: template %q not registered", path, name)
+	}
+	tpl, err := newTemplate(path+".values", name, values)
+	if err != nil {
+		return err
+	}
+	v.Set(reflect.ValueOf(tpl))
+	return nil
+}
@@ -0,0 +1,150 @@
+package urknall
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+type registryUpstream struct {
+	Host string
+	Port int
+}
+
+type registryNginx struct {
+	Version   string `urknall:"required=true"`
+	Workers   int    `urknall:"default=4 max=64"`
+	Gzip      bool
+	Timeout   time.Duration
+	Upstreams []registryUpstream
+	Headers   map[string]string `json:"headers"`
+	Logging   Template
+	genericPkg
+}
+
+type registryLogrotate struct {
+	Days int `urknall:"default=7"`
+	genericPkg
+}
+
+type registryLimits struct {
+	Min, Max int
+}
+
+type registryLimited struct {
+	Limits *registryLimits
+	genericPkg
+}
+
+func init() {
+	RegisterTemplate("test-nginx", &registryNginx{Gzip: true})
+	RegisterTemplate("test-logrotate", &registryLogrotate{})
+	RegisterTemplate("test-limited", &registryLimited{Limits: &registryLimits{Max: 10}})
+}
+
+func decodeJSON(t *testing.T, in string) map[string]interface{} {
+	d := json.NewDecoder(strings.NewReader(in))
+	d.UseNumber()
+	m := map[string]interface{}{}
+	if err := d.Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestRegisterTemplate(t *testing.T) {
+	names := strings.Join(RegisteredTemplates(), ",")
+	if !strings.Contains(names, "test-logrotate,test-nginx") {
+		t.Errorf("expected test templates to be registered, got %q", names)
+	}
+	for _, tpl := range []Template{&registryLogrotate{}, TemplateFunc(threeCommands)} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected registering %T to panic", tpl)
+				}
+			}()
+			RegisterTemplate("test-logrotate", tpl)
+		}()
+	}
+}
+
+func TestNewTemplate(t *testing.T) {
+	tpl, err := NewTemplate("test-nginx", decodeJSON(t, `{
+	  "version": "1.9.4",
+	  "Timeout": "30s",
+	  "upstreams": [{"host": "app1", "port": 8080}, {"host": "app2", "port": 8081}],
+	  "headers": {"X-Frame-Options": "DENY"},
+	  "logging": {"template": "test-logrotate", "values": {"days": 14}}
+	}`))
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	n := tpl.(*registryNginx)
+	if n.Version != "1.9.4" || n.Workers != 4 || !n.Gzip || n.Timeout != 30*time.Second {
+		t.Errorf("unexpected template: %#v", n)
+	}
+	if len(n.Upstreams) != 2 || n.Upstreams[1].Port != 8081 || n.Headers["X-Frame-Options"] != "DENY" {
+		t.Errorf("unexpected upstreams or headers: %#v", n)
+	}
+	if l, ok := n.Logging.(*registryLogrotate); !ok || l.Days != 14 {
+		t.Errorf("expected nested logrotate template, got %#v", n.Logging)
+	}
+
+	// values given as Go values
+	tpl, err = NewTemplate("test-nginx", map[string]interface{}{"Version": "1.8", "Workers": 2, "Upstreams": []map[string]interface{}{{"Host": "app"}}})
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if n := tpl.(*registryNginx); n.Workers != 2 || n.Upstreams[0].Host != "app" {
+		t.Errorf("unexpected template: %#v", n)
+	}
+}
+
+func TestNewTemplateErrors(t *testing.T) {
+	tests := []struct {
+		Values   string
+		Expected string
+	}{
+		{`{"version": "1", "colour": "red"}`, `colour: unknown field`},
+		{`{"version": 1}`, `version: expected string, got number 1`},
+		{`{"version": "1", "workers": 1.5}`, `workers: expected int, got number 1.5`},
+		{`{"version": "1", "timeout": "soon"}`, `timeout: invalid duration "soon"`},
+		{`{"version": "1", "upstreams": [{"host": "a"}, {"host": "b", "port": "80"}]}`, `upstreams[1].port: expected int, got string "80"`},
+		{`{"version": "1", "upstreams": [{"hots": "a"}]}`, `upstreams[0].hots: unknown field`},
+		{`{"version": "1", "headers": {"X": 1}}`, `headers["X"]: expected string, got number 1`},
+		{`{"version": "1", "logging": {"template": "unknown"}}`, `logging.template: template "unknown" not registered`},
+		{`{"version": "1", "logging": {"template": "test-logrotate", "values": {"days": "7"}}}`, `logging.values.days: expected int, got string "7"`},
+		{`{"version": "1", "logging": {"template": "test-logrotate", "value": {}}}`, `logging.value: unknown field`},
+		{`{"workers": 2}`, `[package:registryNginx][field:Version] required field not set`},
+		{`{"version": "1", "workers": 100}`, `[package:registryNginx][field:Workers] value "100" greater than the specified maximum "64"`},
+	}
+	for _, tst := range tests {
+		_, err := NewTemplate("test-nginx", decodeJSON(t, tst.Values))
+		if err == nil {
+			t.Errorf("expected %s to fail", tst.Values)
+		} else if err.Error() != tst.Expected {
+			t.Errorf("expected error for %s to be %q, got %q", tst.Values, tst.Expected, err)
+		}
+	}
+	if _, err := NewTemplate("unknown", nil); err == nil {
+		t.Errorf("expected unregistered template to fail")
+	}
+}
+
+func TestNewTemplateKeepsPrototype(t *testing.T) {
+	for _, min := range []int{1, 2} {
+		tpl, err := NewTemplate("test-limited", map[string]interface{}{"limits": map[string]interface{}{"min": min}})
+		if err != nil {
+			t.Fatalf("didn't expect an error, got %q", err)
+		}
+		if l := tpl.(*registryLimited).Limits; l.Min != min || l.Max != 10 {
+			t.Errorf("expected limits to be decoded onto the prototype's, got %+v", l)
+		}
+	}
+	proto, _ := registeredTemplate("test-limited")
+	if l := proto.(*registryLimited).Limits; l.Min != 0 || l.Max != 10 {
+		t.Errorf("expected prototype to be unmodified, got %+v", l)
+	}
+}
@@ -0,0 +1,199 @@
+package urknall
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dynport/dgtk/confirm"
+)
+
+// A rollout builds a template on a group of hosts in batches, so that e.g. the
+// nodes of a cluster are never updated all at once. The hosts of a batch are
+// built concurrently, batches one after another.
+type Rollout struct {
+	Targets  []Target // Hosts to build, in order.
+	Template Template // What to build on each host.
+
+	Canary       int // Number of hosts built first, that all must succeed before the others are started.
+	BatchSize    int // Number of hosts per batch (1 if neither size nor percentage is given).
+	BatchPercent int // Batch size as percentage of the (non canary) hosts.
+	MaxFailures  int // The rollout is aborted as soon as more hosts failed.
+
+	// If set, it is called before every batch but the first, with an action
+	// running the batch. The batch is only run if the action is called, an
+	// error aborts the rollout.
+	Confirm func(actions ...*confirm.Action) error
+	Pause   time.Duration // Time waited between batches.
+
+	Options []func(*Build) // Applied to the build of every host.
+
+	result *RolloutResult
+}
+
+// Result of a rollout.
+type RolloutResult struct {
+	Hosts   []*HostResult // Hosts built, in order of their batches.
+	Skipped []Target      // Hosts not built as the rollout was aborted.
+}
+
+// Result of building a single host of a rollout.
+type HostResult struct {
+	Target Target
+	Batch  int     // Index of the host's batch (the canaries being the first batch, if given).
+	Error  error   // Error of the host's build, if it failed.
+	Result *Result // Result of the host's build.
+}
+
+// Returns the hosts whose build failed.
+func (r *RolloutResult) Failed() []*HostResult {
+	failed := []*HostResult{}
+	for _, h := range r.Hosts {
+		if h.Error != nil {
+			failed = append(failed, h)
+		}
+	}
+	return failed
+}
+
+// Returns the result of the last run of the rollout (nil if it wasn't run).
+func (r *Rollout) Result() *RolloutResult {
+	return r.result
+}
+
+// Run the rollout. An error is returned if the rollout was aborted or any of
+// the hosts failed.
+func (r *Rollout) Run() error {
+	batches, err := r.batches()
+	if err != nil {
+		return err
+	}
+	r.result = &RolloutResult{}
+
+	failures := 0
+	for i, batch := range batches {
+		// skip all batches starting with the given one
+		abort := func(next int, reason string) error {
+			for _, b := range batches[next:] {
+				r.result.Skipped = append(r.result.Skipped, b...)
+			}
+			return fmt.Errorf("rollout aborted before batch %d of %d: %s", next+1, len(batches), reason)
+		}
+
+		if i > 0 && r.Pause > 0 {
+			time.Sleep(r.Pause)
+		}
+		ran := false
+		run := func() error {
+			ran = true
+			fmt.Printf("rollout batch %d of %d: %s\n", i+1, len(batches), targetNames(batch))
+			r.result.Hosts = append(r.result.Hosts, r.runBatch(i, batch)...)
+			return nil
+		}
+		if i > 0 && r.Confirm != nil {
+			actions := confirm.Actions{}
+			actions.Create(fmt.Sprintf("batch %d of %d: %s", i+1, len(batches), targetNames(batch)), nil, run)
+			if err := r.Confirm(actions...); err != nil {
+				return abort(i, err.Error())
+			}
+			if !ran {
+				return abort(i, "batch not confirmed")
+			}
+		} else {
+			run()
+		}
+
+		failed := 0
+		for _, h := range r.result.Hosts {
+			if h.Batch == i && h.Error != nil {
+				failed++
+			}
+		}
+		failures += failed
+		switch {
+		case i+1 == len(batches):
+		case i == 0 && r.Canary > 0 && failed > 0:
+			return abort(i+1, fmt.Sprintf("%d canary host(s) failed", failed))
+		case failures > r.MaxFailures:
+			return abort(i+1, fmt.Sprintf("%d host(s) failed", failures))
+		}
+	}
+
+	if failed := r.result.Failed(); len(failed) > 0 {
+		msgs := []string{}
+		for _, h := range failed {
+			msgs = append(msgs, h.Target.String()+": "+h.Error.Error())
+		}
+		return fmt.Errorf("rollout failed on %d of %d hosts:\n%s", len(failed), len(r.Targets), strings.Join(msgs, "\n"))
+	}
+	return nil
+}
+
+// Split the targets into the batches of the rollout.
+func (r *Rollout) batches() ([][]Target, error) {
+	switch {
+	case len(r.Targets) == 0:
+		return nil, fmt.Errorf("rollout has no targets")
+	case r.Template == nil:
+		return nil, fmt.Errorf("rollout has no template")
+	case r.Canary < 0 || r.BatchSize < 0 || r.MaxFailures < 0:
+		return nil, fmt.Errorf("canary, batch size and max failures must not be negative")
+	case r.BatchPercent < 0 || r.BatchPercent > 100:
+		return nil, fmt.Errorf("batch percentage must be between 0 and 100")
+	case r.BatchSize > 0 && r.BatchPercent > 0:
+		return nil, fmt.Errorf("either batch size or percentage can be given")
+	case r.Canary >= len(r.Targets):
+		return nil, fmt.Errorf("%d canary host(s) given for %d hosts", r.Canary, len(r.Targets))
+	}
+
+	batches := [][]Target{}
+	hosts := r.Targets
+	if r.Canary > 0 {
+		batches = append(batches, hosts[:r.Canary])
+		hosts = hosts[r.Canary:]
+	}
+	size := r.BatchSize
+	if r.BatchPercent > 0 {
+		size = (len(hosts)*r.BatchPercent + 99) / 100
+	}
+	if size <= 0 {
+		size = 1
+	}
+	for len(hosts) > 0 {
+		if size > len(hosts) {
+			size = len(hosts)
+		}
+		batches = append(batches, hosts[:size])
+		hosts = hosts[size:]
+	}
+	return batches, nil
+}
+
+// Build the given hosts concurrently.
+func (r *Rollout) runBatch(idx int, batch []Target) []*HostResult {
+	results := make([]*HostResult, len(batch))
+	wg := sync.WaitGroup{}
+	for i, t := range batch {
+		wg.Add(1)
+		go func(i int, t Target) {
+			defer wg.Done()
+			b := &Build{Target: t, Template: r.Template}
+			for _, o := range r.Options {
+				o(b)
+			}
+			err := b.Run()
+			results[i] = &HostResult{Target: t, Batch: idx, Error: err, Result: b.Result()}
+		}(i, t)
+	}
+	wg.Wait()
+	return results
+}
+
+func targetNames(targets []Target) string {
+	names := []string{}
+	for _, t := range targets {
+		names = append(names, t.String())
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,175 @@
+package urknall
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dynport/dgtk/confirm"
+	"github.com/dynport/urknall/urknalltest"
+)
+
+func newFakeTargets(t *testing.T, n int) ([]Target, []*urknalltest.Target) {
+	targets := []Target{}
+	fakes := []*urknalltest.Target{}
+	for i := 1; i <= n; i++ {
+		ft := newFakeTarget(t)
+		ft.Name = fmt.Sprintf("h%d", i)
+		targets = append(targets, ft)
+		fakes = append(fakes, ft)
+	}
+	return targets, fakes
+}
+
+func closeAll(fakes []*urknalltest.Target) {
+	for _, ft := range fakes {
+		ft.Close()
+	}
+}
+
+func hostBatches(r *RolloutResult) string {
+	batches := []string{}
+	for _, h := range r.Hosts {
+		for len(batches) <= h.Batch {
+			batches = append(batches, "")
+		}
+		if batches[h.Batch] != "" {
+			batches[h.Batch] += ","
+		}
+		batches[h.Batch] += h.Target.String()
+	}
+	return strings.Join(batches, " ")
+}
+
+func TestRollout(t *testing.T) {
+	targets, fakes := newFakeTargets(t, 5)
+	defer closeAll(fakes)
+
+	confirmed := []string{}
+	r := &Rollout{Targets: targets, Template: TemplateFunc(threeCommands), Canary: 1, BatchSize: 2,
+		Confirm: func(actions ...*confirm.Action) error {
+			for _, a := range actions {
+				confirmed = append(confirmed, a.Key)
+			}
+			return callAll(actions...)
+		},
+	}
+	if err := r.Run(); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := hostBatches(r.Result()), "h1 h2,h3 h4,h5"; v != ex {
+		t.Errorf("expected batches to be %q, got %q", ex, v)
+	}
+	if v, ex := strings.Join(confirmed, "|"), "batch 2 of 3: h2, h3|batch 3 of 3: h4, h5"; v != ex {
+		t.Errorf("expected confirmed actions to be %q, got %q", ex, v)
+	}
+	for _, ft := range fakes {
+		if v := len(ft.Executed()); v != 3 {
+			t.Errorf("expected 3 commands to be executed on %s, got %d", ft, v)
+		}
+	}
+}
+
+func TestRolloutCanaryFailure(t *testing.T) {
+	targets, fakes := newFakeTargets(t, 3)
+	defer closeAll(fakes)
+	fakes[0].Handle("^echo 2$", &urknalltest.Response{ExitStatus: 1})
+
+	r := &Rollout{Targets: targets, Template: TemplateFunc(threeCommands), Canary: 1, BatchSize: 2, MaxFailures: 1}
+	if err := r.Run(); err == nil {
+		t.Fatalf("expected rollout to be aborted")
+	}
+	if v, ex := len(r.Result().Failed()), 1; v != ex {
+		t.Errorf("expected %d failed hosts, got %d", ex, v)
+	}
+	if v, ex := targetNames(r.Result().Skipped), "h2, h3"; v != ex {
+		t.Errorf("expected skipped hosts to be %q, got %q", ex, v)
+	}
+	for _, ft := range fakes[1:] {
+		if v := ft.Executed(); len(v) != 0 {
+			t.Errorf("expected nothing to be executed on %s, got %q", ft, v)
+		}
+	}
+}
+
+func TestRolloutMaxFailures(t *testing.T) {
+	targets, fakes := newFakeTargets(t, 6)
+	defer closeAll(fakes)
+	fakes[0].Handle("^echo 2$", &urknalltest.Response{ExitStatus: 1})
+	fakes[3].Handle("^echo 2$", &urknalltest.Response{ExitStatus: 1})
+
+	r := &Rollout{Targets: targets, Template: TemplateFunc(threeCommands), BatchPercent: 50, MaxFailures: 1}
+	if err := r.Run(); err == nil {
+		t.Fatalf("expected rollout to fail")
+	}
+	if v, ex := hostBatches(r.Result()), "h1,h2,h3 h4,h5,h6"; v != ex {
+		t.Errorf("expected batches to be %q, got %q", ex, v)
+	}
+
+	r = &Rollout{Targets: targets, Template: TemplateFunc(threeCommands), BatchSize: 2, MaxFailures: 0}
+	if err := r.Run(); err == nil {
+		t.Fatalf("expected rollout to be aborted")
+	}
+	if v, ex := targetNames(r.Result().Skipped), "h3, h4, h5, h6"; v != ex {
+		t.Errorf("expected skipped hosts to be %q, got %q", ex, v)
+	}
+}
+
+func TestRolloutDeclined(t *testing.T) {
+	targets, fakes := newFakeTargets(t, 2)
+	defer closeAll(fakes)
+
+	r := &Rollout{Targets: targets, Template: TemplateFunc(threeCommands), Confirm: func(actions ...*confirm.Action) error {
+		return nil
+	}}
+	if err := r.Run(); err == nil || !strings.Contains(err.Error(), "not confirmed") {
+		t.Fatalf("expected rollout to be aborted, got %v", err)
+	}
+	if v := len(fakes[1].Executed()); v != 0 {
+		t.Errorf("expected nothing to be executed on unconfirmed host, got %d commands", v)
+	}
+}
+
+func TestRolloutBatches(t *testing.T) {
+	targets, fakes := newFakeTargets(t, 3)
+	defer closeAll(fakes)
+
+	for _, r := range []*Rollout{
+		{Template: TemplateFunc(threeCommands)},
+		{Targets: targets},
+		{Targets: targets, Template: TemplateFunc(threeCommands), Canary: 3},
+		{Targets: targets, Template: TemplateFunc(threeCommands), BatchSize: 1, BatchPercent: 10},
+		{Targets: targets, Template: TemplateFunc(threeCommands), BatchPercent: 110},
+	} {
+		if _, err := r.batches(); err == nil {
+			t.Errorf("expected %#v to be invalid", r)
+		}
+	}
+}
+
+type rolloutTemplate struct {
+	Version string `urknall:"default=1.0"`
+}
+
+func (tpl *rolloutTemplate) Render(p Package) {
+	p.AddCommands("base", Shell("echo "+tpl.Version))
+}
+
+func TestRolloutRendersCopiesOfTemplate(t *testing.T) {
+	targets, fakes := newFakeTargets(t, 4)
+	defer closeAll(fakes)
+
+	tpl := &rolloutTemplate{}
+	r := &Rollout{Targets: targets, Template: tpl, BatchSize: 4}
+	if err := r.Run(); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if tpl.Version != "" {
+		t.Errorf("expected the shared template to be unmodified, got version %q", tpl.Version)
+	}
+	for _, ft := range fakes {
+		if v, ex := strings.Join(ft.Executed(), ","), "echo 1.0"; v != ex {
+			t.Errorf("expected %q to be executed on %s, got %q", ex, ft, v)
+		}
+	}
+}
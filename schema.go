@@ -0,0 +1,271 @@
+package urknall
+
+import (
+	"fmt"
+	"reflect"
+)
+
+const schemaDraft = "http://json-schema.org/draft-07/schema#"
+
+// Pattern of durations as accepted by time.ParseDuration.
+const durationPattern = `^[-+]?(0|([0-9]*(\.[0-9]*)?(ns|us|µs|μs|ms|s|m|h))+)$`
+
+// A JSON Schema (draft 07), as generated for templates and specs.
+type Schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	Ref                  string             `json:"$ref,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"` // false or a schema
+	Items                *Schema            `json:"items,omitempty"`
+	MinItems             *int64             `json:"minItems,omitempty"`
+	Default              interface{}        `json:"default,omitempty"`
+	Const                interface{}        `json:"const,omitempty"`
+	Minimum              *int64             `json:"minimum,omitempty"`
+	Maximum              *int64             `json:"maximum,omitempty"`
+	MinLength            *int64             `json:"minLength,omitempty"`
+	MaxLength            *int64             `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	AnyOf                []*Schema          `json:"anyOf,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+	Definitions          map[string]*Schema `json:"definitions,omitempty"`
+}
+
+// Generate the JSON Schema of the values of the given template (a pointer to
+// a struct), as decoded by DecodeTemplate. The `urknall` tags of the fields
+// are translated into the respective keywords. Fields of the Template
+// interface type accept any registered template, whose schemas are added as
+// definitions. Properties are named after the fields' json tags or names;
+// unlike the decoder, the schema is case sensitive.
+func TemplateSchema(tpl Template) (*Schema, error) {
+	t := reflect.TypeOf(tpl)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("template must be a pointer to a struct, got %T", tpl)
+	}
+	g := newSchemaGenerator()
+	s, err := g.structSchema(t.Elem())
+	if err != nil {
+		return nil, err
+	}
+	s.Schema = schemaDraft
+	if len(g.definitions) > 0 {
+		s.Definitions = g.definitions
+	}
+	return s, nil
+}
+
+// Generate the JSON Schema of specs (see ParseSpec) using the registered
+// templates.
+func SpecSchema() (*Schema, error) {
+	g := newSchemaGenerator()
+	entries := []*Schema{}
+	for _, name := range RegisteredTemplates() {
+		ref, err := g.templateRef(name)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &Schema{
+			Type: "object",
+			Properties: map[string]*Schema{
+				"hosts":    {Type: "array", Items: &Schema{Type: "string"}, MinItems: int64Ptr(1)},
+				"template": {Const: name},
+				"name":     {Type: "string"},
+				"values":   ref,
+			},
+			Required:             []string{"hosts", "template"},
+			AdditionalProperties: false,
+		})
+	}
+	return &Schema{
+		Schema: schemaDraft,
+		Title:  "urknall spec",
+		Type:   "object",
+		Properties: map[string]*Schema{
+			"builds": {Type: "array", Items: &Schema{OneOf: entries}, MinItems: int64Ptr(1)},
+		},
+		Required:             []string{"builds"},
+		AdditionalProperties: false,
+		Definitions:          g.definitions,
+	}, nil
+}
+
+func int64Ptr(i int64) *int64 {
+	return &i
+}
+
+type schemaGenerator struct {
+	definitions map[string]*Schema    // schemas of registered templates by name
+	inProgress  map[reflect.Type]bool // to detect recursive types
+}
+
+func newSchemaGenerator() *schemaGenerator {
+	return &schemaGenerator{definitions: map[string]*Schema{}, inProgress: map[reflect.Type]bool{}}
+}
+
+// Returns a reference to the definition of the registered template, that is
+// added if missing.
+func (g *schemaGenerator) templateRef(name string) (*Schema, error) {
+	ref := &Schema{Ref: "#/definitions/" + name}
+	if _, ok := g.definitions[name]; ok {
+		return ref, nil
+	}
+	tpl, ok := registeredTemplate(name)
+	if !ok {
+		return nil, fmt.Errorf("template %q not registered", name)
+	}
+	// add a placeholder first, as templates can reference themselves
+	def := &Schema{}
+	g.definitions[name] = def
+	s, err := g.structSchema(reflect.TypeOf(tpl).Elem())
+	if err != nil {
+		return nil, fmt.Errorf("template %q: %s", name, err)
+	}
+	*def = *s
+	return ref, nil
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) (*Schema, error) {
+	if g.inProgress[t] {
+		return nil, fmt.Errorf("recursive type %s not supported", t)
+	}
+	g.inProgress[t] = true
+	defer delete(g.inProgress, t)
+
+	s := &Schema{Title: t.Name(), Type: "object", Properties: map[string]*Schema{}, AdditionalProperties: false}
+	for _, f := range templateFields(t) {
+		fs, err := g.typeSchema(f.field.Type)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %s", f.field.Name, err)
+		}
+		opts, err := parseFieldValidationString(f.field)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %s", f.field.Name, err)
+		}
+		applyValidationOptions(fs, opts)
+		if opts.required {
+			s.Required = append(s.Required, f.name)
+		}
+		s.Properties[f.name] = fs
+	}
+	return s, nil
+}
+
+// Translate the options of the urknall tag (see parseFieldValidationString).
+// As for validation, zero values mean the option isn't set, and min and size
+// of strings only apply to non empty values.
+func applyValidationOptions(s *Schema, opts *validationOptions) {
+	if opts.defaultValue != nil && opts.defaultValue != false {
+		s.Default = opts.defaultValue
+	}
+	switch s.Type {
+	case "integer":
+		if opts.min != 0 {
+			s.Minimum = int64Ptr(opts.min)
+		}
+		if opts.max != 0 {
+			s.Maximum = int64Ptr(opts.max)
+		}
+	case "string":
+		if opts.max != 0 {
+			s.MaxLength = int64Ptr(opts.max)
+		}
+		length := &Schema{}
+		if opts.required || opts.min != 0 {
+			min := opts.min
+			if min == 0 {
+				min = 1
+			}
+			length.MinLength = int64Ptr(min)
+		}
+		if opts.size != 0 {
+			length.MinLength, length.MaxLength = int64Ptr(opts.size), int64Ptr(opts.size)
+		}
+		switch {
+		case length.MinLength == nil:
+		case opts.required:
+			s.MinLength = length.MinLength
+			if length.MaxLength != nil {
+				s.MaxLength = length.MaxLength
+			}
+		default:
+			s.AnyOf = []*Schema{{Const: ""}, length}
+		}
+	case "array":
+		if opts.required {
+			s.MinItems = int64Ptr(1)
+		}
+	}
+}
+
+func (g *schemaGenerator) typeSchema(t reflect.Type) (*Schema, error) {
+	switch {
+	case t == templateType:
+		return g.nestedTemplateSchema()
+	case t == durationType:
+		return &Schema{Type: "string", Pattern: durationPattern}, nil
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string"}, nil
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &Schema{Type: "integer"}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer", Minimum: int64Ptr(0)}, nil
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}, nil
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string"}, nil
+		}
+		items, err := g.typeSchema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Type: "array", Items: items}, nil
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("map keys of type %s not supported", t.Key())
+		}
+		values, err := g.typeSchema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Type: "object", AdditionalProperties: values}, nil
+	case reflect.Struct:
+		return g.structSchema(t)
+	case reflect.Ptr:
+		return g.typeSchema(t.Elem())
+	case reflect.Interface:
+		if t.NumMethod() == 0 {
+			return &Schema{}, nil
+		}
+	}
+	return nil, fmt.Errorf("type %s not supported", t)
+}
+
+// Fields of the Template interface type accept any registered template, given
+// as {"template": <name>, "values": {...}}.
+func (g *schemaGenerator) nestedTemplateSchema() (*Schema, error) {
+	s := &Schema{}
+	for _, name := range RegisteredTemplates() {
+		ref, err := g.templateRef(name)
+		if err != nil {
+			return nil, err
+		}
+		s.OneOf = append(s.OneOf, &Schema{
+			Type:                 "object",
+			Properties:           map[string]*Schema{"template": {Const: name}, "values": ref},
+			Required:             []string{"template"},
+			AdditionalProperties: false,
+		})
+	}
+	if len(s.OneOf) == 0 {
+		return nil, fmt.Errorf("no templates registered")
+	}
+	return s, nil
+}
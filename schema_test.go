@@ -0,0 +1,116 @@
+package urknall
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func schemaJSON(t *testing.T, s *Schema) string {
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestTemplateSchema(t *testing.T) {
+	type pkg struct {
+		Name     string            `urknall:"required=true max=16"`
+		Hostname string            `urknall:"min=3 default=localhost"`
+		Key      string            `urknall:"size=8"`
+		Port     int               `urknall:"default=80 min=1 max=65535"`
+		Enabled  bool              `urknall:"default=true"`
+		Users    []string          `urknall:"required=true"`
+		Limits   map[string]uint16 `json:"limits"`
+		Logging  Template
+		secret   string
+		genericPkg
+	}
+	s, err := TemplateSchema(&pkg{})
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := strings.Join(s.Required, ","), "Name,Users"; v != ex {
+		t.Errorf("expected required properties to be %q, got %q", ex, v)
+	}
+	if _, ok := s.Properties["secret"]; ok {
+		t.Errorf("expected unexported fields to be skipped")
+	}
+
+	tests := []struct {
+		Property string
+		Expected string
+	}{
+		{"Name", `{"type":"string","minLength":1,"maxLength":16}`},
+		{"Hostname", `{"type":"string","default":"localhost","anyOf":[{"const":""},{"minLength":3}]}`},
+		{"Key", `{"type":"string","anyOf":[{"const":""},{"minLength":8,"maxLength":8}]}`},
+		{"Port", `{"type":"integer","default":80,"minimum":1,"maximum":65535}`},
+		{"Enabled", `{"type":"boolean","default":true}`},
+		{"Users", `{"type":"array","items":{"type":"string"},"minItems":1}`},
+		{"limits", `{"type":"object","additionalProperties":{"type":"integer","minimum":0}}`},
+	}
+	for _, tst := range tests {
+		p, ok := s.Properties[tst.Property]
+		if !ok {
+			t.Errorf("expected property %q", tst.Property)
+			continue
+		}
+		if v := schemaJSON(t, p); v != tst.Expected {
+			t.Errorf("expected schema of %s to be\n%s\ngot\n%s", tst.Property, tst.Expected, v)
+		}
+	}
+
+	// nested templates reference the registered ones
+	logging := schemaJSON(t, s.Properties["Logging"])
+	for _, name := range []string{"test-logrotate", "test-nginx", "test-echo"} {
+		if !strings.Contains(logging, `{"const":"`+name+`"},"values":{"$ref":"#/definitions/`+name+`"}`) {
+			t.Errorf("expected nested template to accept %s, got %s", name, logging)
+		}
+		if _, ok := s.Definitions[name]; !ok {
+			t.Errorf("expected definition of %s", name)
+		}
+	}
+	if v, ex := schemaJSON(t, s.Definitions["test-logrotate"]), `{"title":"registryLogrotate","type":"object","properties":{"Days":{"type":"integer","default":7}},"additionalProperties":false}`; v != ex {
+		t.Errorf("expected definition of test-logrotate to be\n%s\ngot\n%s", ex, v)
+	}
+	if v := schemaJSON(t, s.Definitions["test-nginx"].Properties["Timeout"]); !strings.Contains(v, `"pattern"`) {
+		t.Errorf("expected durations to be strings with a pattern, got %s", v)
+	}
+}
+
+func TestTemplateSchemaErrors(t *testing.T) {
+	type unsupported struct {
+		Callback func()
+		genericPkg
+	}
+	type invalidTag struct {
+		Port int `urknall:"size=3"`
+		genericPkg
+	}
+	for _, tpl := range []Template{&unsupported{}, &invalidTag{}, TemplateFunc(threeCommands)} {
+		if _, err := TemplateSchema(tpl); err == nil {
+			t.Errorf("expected schema of %T to fail", tpl)
+		}
+	}
+}
+
+func TestSpecSchema(t *testing.T) {
+	s, err := SpecSchema()
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	entries := s.Properties["builds"].Items.OneOf
+	if len(entries) != len(RegisteredTemplates()) {
+		t.Fatalf("expected an entry per registered template, got %d", len(entries))
+	}
+	v := schemaJSON(t, s)
+	for _, ex := range []string{
+		`"template":{"const":"test-echo"},"values":{"$ref":"#/definitions/test-echo"}`,
+		`"test-echo":{"title":"specEcho","type":"object","properties":{"Message":{"type":"string","minLength":1}},"required":["Message"],"additionalProperties":false}`,
+	} {
+		if !strings.Contains(v, ex) {
+			t.Errorf("expected spec schema to contain %s, got %s", ex, v)
+		}
+	}
+}
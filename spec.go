@@ -0,0 +1,149 @@
+package urknall
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// A spec declares which registered templates (see RegisterTemplate) are built
+// on which hosts, and the values of their fields. It is read from JSON:
+//
+//	{
+//	  "builds": [
+//	    { "hosts": ["all"], "template": "base" },
+//	    {
+//	      "hosts": ["elasticsearch", "es-test"],
+//	      "template": "elasticsearch",
+//	      "values": { "version": "1.7.1", "heap_size": "4g" }
+//	    }
+//	  ]
+//	}
+//
+// Hosts are given by name (like hosts and groups of an inventory) and resolved
+// to targets when the builds are created.
+type Spec struct {
+	Builds []*SpecEntry `json:"builds"`
+}
+
+// Entry of a spec, mapping hosts to a template.
+type SpecEntry struct {
+	Hosts    []string               `json:"hosts"`          // Names of hosts or groups.
+	Template string                 `json:"template"`       // Name of the registered template.
+	Name     string                 `json:"name,omitempty"` // Name of the template's package (the template name if empty).
+	Values   map[string]interface{} `json:"values,omitempty"`
+}
+
+func (e *SpecEntry) name() string {
+	if e.Name != "" {
+		return e.Name
+	}
+	return e.Template
+}
+
+// Load the spec from the given file.
+func LoadSpec(path string) (*Spec, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s, err := ParseSpec(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load spec %s: %s", path, err)
+	}
+	return s, nil
+}
+
+// Parse a spec. All entries are validated, i.e. their templates must be
+// registered and the values must decode into them.
+func ParseSpec(r io.Reader) (*Spec, error) {
+	s := &Spec{}
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	dec.UseNumber()
+	if err := dec.Decode(s); err != nil {
+		return nil, err
+	}
+	return s, s.Validate()
+}
+
+// Validate the spec's entries by instantiating their templates.
+func (s *Spec) Validate() error {
+	if len(s.Builds) == 0 {
+		return fmt.Errorf("no builds given")
+	}
+	for i, e := range s.Builds {
+		if len(e.Hosts) == 0 {
+			return fmt.Errorf("builds[%d].hosts: no hosts given", i)
+		}
+		if _, ok := registeredTemplate(e.Template); !ok {
+			return fmt.Errorf("builds[%d].template: template %q not registered", i, e.Template)
+		}
+		if _, err := e.instantiate(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *SpecEntry) instantiate(idx int) (Template, error) {
+	return newTemplate(fmt.Sprintf("builds[%d].values", idx), e.Template, e.Values)
+}
+
+// Create the builds of the spec, one per host. The hosts function resolves
+// host and group names to the names of the selected hosts, the target function
+// returns the target of a host, e.g. the HostNames and Target methods of an
+// inventory. The templates of all entries matching a host are built as packages named
+// after the entry (see SpecEntry.Name), in order of the entries. Every host
+// gets its own instances of the templates.
+func (s *Spec) CreateBuilds(hosts func(names ...string) ([]string, error), target func(host string) (Target, error)) ([]*Build, error) {
+	builds := []*Build{}
+	byHost := map[string]*specHost{}
+	for i, e := range s.Builds {
+		names, err := hosts(e.Hosts...)
+		if err != nil {
+			return nil, fmt.Errorf("builds[%d].hosts: %s", i, err)
+		}
+		for _, name := range names {
+			h, ok := byHost[name]
+			if !ok {
+				t, err := target(name)
+				if err != nil {
+					return nil, fmt.Errorf("builds[%d].hosts: %s", i, err)
+				}
+				h = &specHost{names: map[string]struct{}{}}
+				byHost[name] = h
+				builds = append(builds, &Build{Target: t, Template: h})
+			}
+			if _, ok := h.names[e.name()]; ok {
+				return nil, fmt.Errorf("builds[%d]: package %q added twice to host %s", i, e.name(), name)
+			}
+			tpl, err := e.instantiate(i)
+			if err != nil {
+				return nil, err
+			}
+			h.names[e.name()] = struct{}{}
+			h.entries = append(h.entries, &specTemplate{name: e.name(), tpl: tpl})
+		}
+	}
+	return builds, nil
+}
+
+type specTemplate struct {
+	name string
+	tpl  Template
+}
+
+// Template of a host, adding the templates of all matching entries.
+type specHost struct {
+	names   map[string]struct{}
+	entries []*specTemplate
+}
+
+func (h *specHost) Render(p Package) {
+	for _, e := range h.entries {
+		p.AddTemplate(e.name, e.tpl)
+	}
+}
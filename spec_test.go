@@ -0,0 +1,123 @@
+package urknall
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/dynport/urknall/target"
+)
+
+type specEcho struct {
+	Message string `urknall:"required=true"`
+}
+
+func (s *specEcho) Render(p Package) {
+	p.AddCommands("echo", &stringCommand{cmd: "echo {{ .Message }}"})
+}
+
+func init() {
+	RegisterTemplate("test-echo", &specEcho{})
+}
+
+const testSpec = `{
+  "builds": [
+    { "hosts": ["all"], "template": "test-echo", "name": "base", "values": { "message": "base" } },
+    { "hosts": ["web"], "template": "test-echo", "values": { "message": "web" } }
+  ]
+}`
+
+func TestSpecBuilds(t *testing.T) {
+	targets, fakes := newFakeTargets(t, 3)
+	defer closeAll(fakes)
+	resolve := func(names ...string) ([]string, error) {
+		switch strings.Join(names, ",") {
+		case "all":
+			return []string{"h0", "h1", "h2"}, nil
+		case "web":
+			return []string{"h1", "h2"}, nil
+		}
+		return nil, fmt.Errorf("unknown hosts %v", names)
+	}
+	target := func(host string) (Target, error) {
+		return targets[host[1]-'0'], nil
+	}
+
+	s, err := ParseSpec(strings.NewReader(testSpec))
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	builds, err := s.CreateBuilds(resolve, target)
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if len(builds) != 3 {
+		t.Fatalf("expected a build per host, got %d", len(builds))
+	}
+	for i, b := range builds {
+		if err := b.Run(); err != nil {
+			t.Fatalf("didn't expect an error, got %q", err)
+		}
+		ex := "echo base"
+		if i > 0 {
+			ex += ",echo web"
+		}
+		if v := strings.Join(fakes[i].Executed(), ","); v != ex {
+			t.Errorf("expected %s to execute %q, got %q", fakes[i], ex, v)
+		}
+	}
+
+	s.Builds[1].Hosts = []string{"db"}
+	if _, err := s.CreateBuilds(resolve, target); err == nil || !strings.HasPrefix(err.Error(), "builds[1].hosts: ") {
+		t.Errorf("expected unknown hosts to fail, got %v", err)
+	}
+	s.Builds[1].Hosts = []string{"all"}
+	s.Builds[1].Name = "base"
+	if _, err := s.CreateBuilds(resolve, target); err == nil || !strings.Contains(err.Error(), `package "base" added twice`) {
+		t.Errorf("expected duplicate packages to fail, got %v", err)
+	}
+}
+
+func TestSpecBuildsPerHost(t *testing.T) {
+	addrs := map[string]string{"a": "root@10.0.0.1:22", "b": "root@10.0.0.1:2222"}
+	resolve := func(names ...string) ([]string, error) {
+		return []string{"a", "b"}, nil
+	}
+	tgt := func(host string) (Target, error) {
+		return target.NewSshTarget(addrs[host])
+	}
+
+	s, err := ParseSpec(strings.NewReader(testSpec))
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	builds, err := s.CreateBuilds(resolve, tgt)
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if len(builds) != 2 {
+		t.Errorf("expected a build per host sharing an address, got %d", len(builds))
+	}
+}
+
+func TestParseSpecErrors(t *testing.T) {
+	tests := []struct {
+		Spec     string
+		Expected string
+	}{
+		{`{"builds": []}`, `no builds given`},
+		{`{"builds": [{"template": "test-echo"}]}`, `builds[0].hosts: no hosts given`},
+		{`{"builds": [{"hosts": ["a"], "template": "nginx"}]}`, `builds[0].template: template "nginx" not registered`},
+		{`{"builds": [{"hosts": ["a"], "template": "test-echo", "values": {"message": "a"}}, {"hosts": ["a"], "template": "test-echo", "values": {"message": ["a"]}}]}`, `builds[1].values.message: expected string, got array`},
+		{`{"builds": [{"hosts": ["a"], "template": "test-echo", "values": {"mesage": "a"}}]}`, `builds[0].values.mesage: unknown field`},
+		{`{"builds": [{"hosts": ["a"], "template": "test-echo"}]}`, `builds[0].values: [package:specEcho][field:Message] required field not set`},
+	}
+	for _, tst := range tests {
+		_, err := ParseSpec(strings.NewReader(tst.Spec))
+		if err == nil {
+			t.Errorf("expected %s to fail", tst.Spec)
+		} else if err.Error() != tst.Expected {
+			t.Errorf("expected error for %s to be %q, got %q", tst.Spec, tst.Expected, err)
+		}
+	}
+}
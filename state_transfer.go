@@ -0,0 +1,281 @@
+package urknall
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dynport/urknall/utils"
+)
+
+// The manifest of exported state.
+type StateManifest struct {
+	Host     string            `json:"host"`     // Host the state was exported from.
+	Revision string            `json:"revision"` // Revision of the template (see TemplateRevision).
+	Created  time.Time         `json:"created"`
+	Files    map[string]string `json:"files"` // sha256 of the contained files by path.
+}
+
+const (
+	manifestFileName = "manifest.json"
+	stateFileName    = "state.tar.gz"
+)
+
+// Returns a hash over the names and command checksums of all tasks of the
+// rendered template. Hosts built from templates with the same revision have
+// the same state.
+func (b *Build) TemplateRevision() (string, error) {
+	pkg, err := b.renderTemplate()
+	if err != nil {
+		return "", err
+	}
+	return templateRevision(pkg), nil
+}
+
+func templateRevision(pkg *packageImpl) string {
+	h := sha256.New()
+	for _, t := range pkg.tasks {
+		fmt.Fprintf(h, "%s\n", t.name)
+		for _, c := range t.commands {
+			fmt.Fprintf(h, "\t%s\n", c.Checksum())
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Export the urknall state of the build's target (the task directories with
+// their latest run files, the executed scripts and teardowns) to w. The
+// export is a tar archive containing the state and a manifest with the
+// checksums of all files and the revision of the build's template.
+func (b *Build) ExportState(w io.Writer) (*StateManifest, error) {
+	pkg, err := b.renderTemplate()
+	if err != nil {
+		return nil, err
+	}
+	var state []byte
+	var files map[string]string
+	err = b.withLock(func() error {
+		raw, err := capture(b.Target, stateCmd)
+		if err != nil {
+			return err
+		}
+		state, files, err = filterStateArchive(raw)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	m := &StateManifest{Host: b.Target.String(), Revision: templateRevision(pkg), Created: time.Now().UTC(), Files: files}
+	mb, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	t := tar.NewWriter(w)
+	for _, f := range []struct {
+		name    string
+		content []byte
+	}{{manifestFileName, mb}, {stateFileName, state}} {
+		h := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content)), ModTime: m.Created}
+		if err := t.WriteHeader(h); err != nil {
+			return nil, err
+		}
+		if _, err := t.Write(f.content); err != nil {
+			return nil, err
+		}
+	}
+	return m, t.Close()
+}
+
+// Rewrite the archive read from the host, so that it only contains the
+// files below the state directory (the current hashes of tracked paths are
+// host specific). Returns the new archive and the checksums of its files.
+func filterStateArchive(raw []byte) ([]byte, map[string]string, error) {
+	files := map[string]string{}
+	buf := &bytes.Buffer{}
+	if len(raw) == 0 {
+		return nil, files, nil
+	}
+	gzr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer gzr.Close()
+	gzw := gzip.NewWriter(buf)
+	w := tar.NewWriter(gzw)
+	r := tar.NewReader(gzr)
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if !isStatePath(h.Name) {
+			continue
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := w.WriteHeader(h); err != nil {
+			return nil, nil, err
+		}
+		if _, err := w.Write(b); err != nil {
+			return nil, nil, err
+		}
+		files[h.Name] = fmt.Sprintf("%x", sha256.Sum256(b))
+	}
+	if err := w.Close(); err != nil {
+		return nil, nil, err
+	}
+	if err := gzw.Close(); err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), files, nil
+}
+
+// Files of the state are stored as "<task>/<file>", relative to the state
+// directory.
+func isStatePath(name string) bool {
+	clean := path.Clean(name)
+	parts := strings.Split(clean, "/")
+	return len(parts) == 2 && parts[0] != "" && parts[0] != ".." && parts[1] != ".." && !strings.HasSuffix(clean, ".current")
+}
+
+// Import state exported with ExportState to the build's target. The
+// checksums of all files are validated. The import is refused if the
+// revision of the build's template differs from the exported one, or if the
+// target has state already, unless forced. A forced import replaces the
+// directories of the tasks contained in the export.
+func (b *Build) ImportState(r io.Reader, force bool) (*StateManifest, error) {
+	var m *StateManifest
+	var state []byte
+	t := tar.NewReader(r)
+	for {
+		h, err := t.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadAll(t)
+		if err != nil {
+			return nil, err
+		}
+		switch h.Name {
+		case manifestFileName:
+			m = &StateManifest{}
+			if err := json.Unmarshal(b, m); err != nil {
+				return nil, fmt.Errorf("failed to parse manifest: %s", err)
+			}
+		case stateFileName:
+			state = b
+		default:
+			return nil, fmt.Errorf("unexpected file %q in state export", h.Name)
+		}
+	}
+	if m == nil {
+		return nil, fmt.Errorf("state export contains no manifest")
+	}
+	if err := validateStateArchive(state, m.Files); err != nil {
+		return nil, err
+	}
+
+	pkg, err := b.renderTemplate()
+	if err != nil {
+		return nil, err
+	}
+	if rev := templateRevision(pkg); rev != m.Revision && !force {
+		return nil, fmt.Errorf("state was exported for template revision %s, but revision is %s", m.Revision, rev)
+	}
+	err = b.withLock(func() error {
+		existing, err := readState(b.Target)
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 && !force {
+			return fmt.Errorf("target %s has state already", b.Target.String())
+		}
+		if len(state) == 0 {
+			return nil
+		}
+
+		tasks := []string{}
+		seen := map[string]struct{}{}
+		for name := range m.Files {
+			task := path.Dir(path.Clean(name))
+			if _, ok := seen[task]; !ok {
+				seen[task] = struct{}{}
+				tasks = append(tasks, utils.ShellQuote(task))
+			}
+		}
+		sort.Strings(tasks)
+		raw := fmt.Sprintf("mkdir -p %[1]s && cd %[1]s && rm -rf -- %[2]s && tar xz", utils.ShellQuote(ukCACHEDIR), strings.Join(tasks, " "))
+		c, err := b.prepareCommandWithStdin("bash -c " + utils.ShellQuote(raw))
+		if err != nil {
+			return err
+		}
+		c.SetStdin(bytes.NewReader(state))
+		if err := runCaptured(c); err != nil {
+			return fmt.Errorf("failed to import state: %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Make sure the archive contains exactly the files of the manifest, all with
+// matching checksums, and nothing outside the state directory.
+func validateStateArchive(state []byte, files map[string]string) error {
+	seen := map[string]struct{}{}
+	if len(state) > 0 {
+		gz, err := gzip.NewReader(bytes.NewReader(state))
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		t := tar.NewReader(gz)
+		for {
+			h, err := t.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			if !isStatePath(h.Name) || !h.FileInfo().Mode().IsRegular() {
+				return fmt.Errorf("invalid entry %q in state", h.Name)
+			}
+			b, err := ioutil.ReadAll(t)
+			if err != nil {
+				return err
+			}
+			expected, ok := files[h.Name]
+			if !ok {
+				return fmt.Errorf("file %q not listed in manifest", h.Name)
+			}
+			if cs := fmt.Sprintf("%x", sha256.Sum256(b)); cs != expected {
+				return fmt.Errorf("checksum mismatch for %q: expected %s, got %s", h.Name, expected, cs)
+			}
+			seen[h.Name] = struct{}{}
+		}
+	}
+	for name := range files {
+		if _, ok := seen[name]; !ok {
+			return fmt.Errorf("file %q of manifest missing in state", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package urknall
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportAndImportState(t *testing.T) {
+	golden := newFakeTarget(t)
+	defer golden.Close()
+
+	if err := Run(golden, TemplateFunc(threeCommands)); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	export := &bytes.Buffer{}
+	m, err := (&Build{Target: golden, Template: TemplateFunc(threeCommands)}).ExportState(export)
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if len(m.Files) != 4 { // the run file and three scripts
+		t.Errorf("expected 4 files in manifest, got %v", m.Files)
+	}
+
+	replica := newFakeTarget(t)
+	defer replica.Close()
+	b := &Build{Target: replica, Template: TemplateFunc(threeCommands)}
+	if _, err := b.ImportState(bytes.NewReader(export.Bytes()), false); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if err := b.Run(); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v := replica.Executed(); len(v) != 0 {
+		t.Errorf("expected imported state to prevent execution, got %q", v)
+	}
+	if _, err := b.ImportState(bytes.NewReader(export.Bytes()), false); err == nil || !strings.Contains(err.Error(), "has state already") {
+		t.Errorf("expected import onto host with state to fail, got %v", err)
+	}
+
+	other := newFakeTarget(t)
+	defer other.Close()
+	b = &Build{Target: other, Template: TemplateFunc(func(p Package) { p.AddCommands("base", Shell("echo 1")) })}
+	if _, err := b.ImportState(bytes.NewReader(export.Bytes()), false); err == nil || !strings.Contains(err.Error(), "template revision") {
+		t.Errorf("expected import for different revision to fail, got %v", err)
+	}
+	if _, err := b.ImportState(bytes.NewReader(export.Bytes()), true); err != nil {
+		t.Errorf("expected forced import to succeed, got %q", err)
+	}
+}
+
+func TestImportStateValidatesChecksums(t *testing.T) {
+	golden := newFakeTarget(t)
+	defer golden.Close()
+
+	if err := Run(golden, TemplateFunc(threeCommands)); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	export := &bytes.Buffer{}
+	m, err := (&Build{Target: golden, Template: TemplateFunc(threeCommands)}).ExportState(export)
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+
+	// replace the manifest with one listing a wrong checksum
+	var state []byte
+	r := tar.NewReader(bytes.NewReader(export.Bytes()))
+	for {
+		h, err := r.Next()
+		if err != nil {
+			break
+		}
+		if h.Name == stateFileName {
+			state, _ = ioutil.ReadAll(r)
+		}
+	}
+	for name := range m.Files {
+		m.Files[name] = strings.Repeat("0", 64)
+		break
+	}
+	mb, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := &bytes.Buffer{}
+	w := tar.NewWriter(tampered)
+	for name, content := range map[string][]byte{manifestFileName: mb, stateFileName: state} {
+		w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))})
+		w.Write(content)
+	}
+	w.Close()
+
+	replica := newFakeTarget(t)
+	defer replica.Close()
+	b := &Build{Target: replica, Template: TemplateFunc(threeCommands)}
+	if _, err := b.ImportState(tampered, false); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+}
+
+func TestForcedImportReplacesTaskState(t *testing.T) {
+	golden := newFakeTarget(t)
+	defer golden.Close()
+
+	if err := Run(golden, TemplateFunc(threeCommands)); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	export := &bytes.Buffer{}
+	if _, err := (&Build{Target: golden, Template: TemplateFunc(threeCommands)}).ExportState(export); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+
+	replica := newFakeTarget(t)
+	defer replica.Close()
+	if err := Run(replica, TemplateFunc(func(p Package) { p.AddCommands("base", Shell("echo 4")) })); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	b := &Build{Target: replica, Template: TemplateFunc(threeCommands)}
+	if _, err := b.ImportState(bytes.NewReader(export.Bytes()), true); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	builds, err := filepath.Glob(filepath.Join(replica.StateDir(), "base", "build.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 0 {
+		t.Errorf("expected the task's state to be replaced by the imported one, got builds %q", builds)
+	}
+	if err := b.Run(); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := strings.Join(replica.Executed(), ","), "echo 4"; v != ex {
+		t.Errorf("expected imported state to prevent execution, got %q", v)
+	}
+}
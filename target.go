@@ -1,6 +1,10 @@
 package urknall
 
-import "github.com/dynport/urknall/target"
+import (
+	"fmt"
+
+	"github.com/dynport/urknall/target"
+)
 
 // The target interface is used to describe something a package can be built
 // on.
@@ -24,6 +28,21 @@ func NewSshTargetWithPrivateKey(address string, key []byte) (Target, error) {
 	return target.NewSshTargetWithPrivateKey(address, key)
 }
 
+// Create a SSH target that tunnels all connections through the given bastion
+// host (of the same address form), like ssh's ProxyJump. Both hosts are
+// accessed using the local SSH agent.
+func NewSshTargetWithBastion(address, bastion string) (Target, error) {
+	t, e := target.NewSshTarget(address)
+	if e != nil {
+		return nil, e
+	}
+	t.Bastion, e = target.NewSshTarget(bastion)
+	if e != nil {
+		return nil, fmt.Errorf("invalid bastion: %s", e)
+	}
+	return t, nil
+}
+
 // Special SSH target that uses the given password for accessing the machine.
 // This is required mostly for testing and shouldn't be used in production
 // settings.
@@ -35,7 +54,47 @@ func NewSshTargetWithPassword(address, password string) (Target, error) {
 	return target, e
 }
 
+// Create a SSH target that forwards the local SSH agent (as given by
+// SSH_AUTH_SOCK) into all sessions. Thereby commands on the remote host can
+// authenticate using the local keys, for cloning private repositories for
+// example.
+func NewSshTargetWithAgentForwarding(address string) (Target, error) {
+	target, e := target.NewSshTarget(address)
+	if e == nil {
+		target.ForwardAgent = true
+	}
+	return target, e
+}
+
+// Create a SSH target that allocates a pseudo terminal with the given settings
+// for all build commands (some distributions require a TTY for sudo). If pty is
+// nil the defaults are used. Please note that stderr of the commands is merged
+// into stdout.
+func NewSshTargetWithPty(address string, pty *target.Pty) (Target, error) {
+	t, e := target.NewSshTarget(address)
+	if e == nil {
+		if pty == nil {
+			pty = &target.Pty{}
+		}
+		t.Pty = pty
+	}
+	return t, e
+}
+
 // Use the local host for building.
 func NewLocalTarget() (Target, error) {
 	return target.NewLocalTarget(), nil
 }
+
+// Use a local command prefix for building, like "docker exec -i <container>",
+// "lxc exec <name> --", "chroot /mnt/image" or "systemd-nspawn -D <dir>". The
+// commands are appended to the prefix as "bash -c <cmd>". The name is used for
+// display only and user is the one commands are executed as (root if empty),
+// see target.NewExecTarget for how it is passed to the wrapper.
+func NewExecTarget(name, user string, prefix ...string) (Target, error) {
+	t, e := target.NewExecTarget(name, user, prefix...)
+	if e != nil {
+		return nil, e
+	}
+	return t, nil
+}
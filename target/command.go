@@ -13,3 +13,17 @@ type ExecCommand interface {
 	Start() error
 	Wait() error
 }
+
+// Commands of targets that can forward the local SSH agent into the session
+// implement this interface.
+type AgentForwarder interface {
+	ForwardAgent() error
+}
+
+// Commands of targets that can allocate a pseudo terminal for the session
+// implement this interface. PtyEnabled reports whether the target was
+// configured to allocate a PTY for all build commands.
+type PtyRequester interface {
+	RequestPty() error
+	PtyEnabled() bool
+}
@@ -0,0 +1,77 @@
+package target
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Create a target that runs all commands through the given local command
+// prefix, like "docker exec -i <container>", "lxc exec <name> --", "chroot
+// /mnt/image" or "systemd-nspawn -D <dir>". The command is appended to the
+// prefix as "bash -c <cmd>". The name is used for display only and the user is
+// the one commands are executed as (root if empty). Other users are passed to
+// docker, podman, chroot and systemd-nspawn using their respective options;
+// commands of other wrappers (like lxc) are run via runuser.
+func NewExecTarget(name, user string, prefix ...string) (*execTarget, error) {
+	if len(prefix) == 0 {
+		return nil, fmt.Errorf("empty command prefix given for target")
+	}
+	if user == "" {
+		user = "root"
+	}
+	return &execTarget{name: name, user: user, prefix: prefix, args: userPrefix(prefix, user)}, nil
+}
+
+type execTarget struct {
+	name   string
+	user   string
+	prefix []string
+	args   []string // prefix including the user option
+}
+
+// Add the option executing commands as the given user to the prefix.
+func userPrefix(prefix []string, user string) []string {
+	if user == "root" {
+		return prefix
+	}
+	insert := func(i int, args ...string) []string {
+		return append(append(append([]string{}, prefix[:i]...), args...), prefix[i:]...)
+	}
+	switch filepath.Base(prefix[0]) {
+	case "docker", "podman":
+		for i, arg := range prefix {
+			if arg == "exec" {
+				return insert(i+1, "-u", user)
+			}
+		}
+	case "chroot":
+		return insert(1, "--userspec="+user)
+	case "systemd-nspawn":
+		return insert(1, "-u", user)
+	}
+	return append(append([]string{}, prefix...), "runuser", "-u", user, "--")
+}
+
+func (t *execTarget) String() string {
+	if t.name == "" {
+		return strings.Join(t.prefix, " ")
+	}
+	return t.name
+}
+
+func (t *execTarget) User() string {
+	return t.user
+}
+
+func (t *execTarget) Command(cmd string) (ExecCommand, error) {
+	args := append(append([]string{}, t.args[1:]...), "bash", "-c", cmd)
+	return &localCommand{
+		command: exec.Command(t.args[0], args...),
+	}, nil
+}
+
+func (t *execTarget) Reset() error {
+	return nil
+}
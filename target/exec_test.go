@@ -0,0 +1,111 @@
+package target
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const fakeWrapper = `#!/bin/sh
+echo "$1" >> "$(dirname "$0")/calls"
+shift
+exec "$@"
+`
+
+func TestExecTarget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "urknall-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wrapper := filepath.Join(dir, "wrapper")
+	if err := ioutil.WriteFile(wrapper, []byte(fakeWrapper), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tgt, err := NewExecTarget("", "", wrapper, "ctr")
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := tgt.User(), "root"; v != ex {
+		t.Errorf("expected user to be %q, was %q", ex, v)
+	}
+	if v, ex := tgt.String(), wrapper+" ctr"; v != ex {
+		t.Errorf("expected name to be %q, was %q", ex, v)
+	}
+
+	c, err := tgt.Command(`echo "hello $((1+2))"; echo err >&2`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	c.SetStdout(stdout)
+	c.SetStderr(stderr)
+	if err := c.Run(); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := stdout.String(), "hello 3\n"; v != ex {
+		t.Errorf("expected stdout to be %q, was %q", ex, v)
+	}
+	if v, ex := stderr.String(), "err\n"; v != ex {
+		t.Errorf("expected stderr to be %q, was %q", ex, v)
+	}
+
+	c, err = tgt.Command("exit 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Run(); err == nil {
+		t.Errorf("expected exit status to be propagated, got no error")
+	}
+
+	calls, err := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ex := string(calls), "ctr\nctr\n"; v != ex {
+		t.Errorf("expected wrapper calls to be %q, was %q", ex, v)
+	}
+}
+
+func TestExecTargetWithoutPrefix(t *testing.T) {
+	if _, err := NewExecTarget("image", "root"); err == nil {
+		t.Errorf("expected an error for an empty prefix, got none")
+	}
+}
+
+func TestExecTargetUser(t *testing.T) {
+	tests := []struct {
+		Prefix   []string
+		Expected string
+	}{
+		{[]string{"docker", "exec", "-i", "ctr"}, "docker exec -u app -i ctr"},
+		{[]string{"/usr/bin/podman", "exec", "-i", "ctr"}, "/usr/bin/podman exec -u app -i ctr"},
+		{[]string{"chroot", "/mnt/image"}, "chroot --userspec=app /mnt/image"},
+		{[]string{"systemd-nspawn", "-D", "dir"}, "systemd-nspawn -u app -D dir"},
+		{[]string{"lxc", "exec", "name", "--"}, "lxc exec name -- runuser -u app --"},
+	}
+	for _, tst := range tests {
+		tgt, err := NewExecTarget("", "app", tst.Prefix...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := strings.Join(tgt.args, " "); v != tst.Expected {
+			t.Errorf("expected command prefix to be %q, was %q", tst.Expected, v)
+		}
+		if v, ex := tgt.String(), strings.Join(tst.Prefix, " "); v != ex {
+			t.Errorf("expected name to be %q, was %q", ex, v)
+		}
+	}
+
+	tgt, err := NewExecTarget("", "root", "docker", "exec", "ctr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ex := strings.Join(tgt.args, " "), "docker exec ctr"; v != ex {
+		t.Errorf("expected command prefix of root to be %q, was %q", ex, v)
+	}
+}
@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"strings"
+
+	"github.com/dynport/urknall/utils"
 )
 
 // Create a target for local provisioning.
@@ -61,6 +64,37 @@ func (c *localTarget) Reset() (e error) {
 	return nil
 }
 
+// Copy the content read from r to the given path. Like for SSH targets the
+// content is written to a temporary file first, that is moved into place using
+// sudo (if the user isn't root).
+func (c *localTarget) Upload(r io.Reader, path string, opts *UploadOptions) (e error) {
+	f, e := ioutil.TempFile("", "urknall.upload.")
+	if e != nil {
+		return e
+	}
+	defer os.Remove(f.Name())
+	if _, e = io.Copy(f, r); e != nil {
+		f.Close()
+		return e
+	}
+	if e = f.Close(); e != nil {
+		return e
+	}
+
+	rawCmd, e := finalizeUploadCmd(f.Name(), path, opts)
+	if e != nil {
+		return e
+	}
+	if c.User() != "root" {
+		rawCmd = "sudo sh -c " + utils.ShellQuote(rawCmd)
+	}
+	out, e := exec.Command("sh", "-c", rawCmd).CombinedOutput()
+	if e != nil {
+		return fmt.Errorf("failed to move uploaded file to %q: %s (%s)", path, e, string(out))
+	}
+	return nil
+}
+
 type localCommand struct {
 	command *exec.Cmd
 }
@@ -0,0 +1,75 @@
+package target
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/sftp"
+
+	"github.com/dynport/urknall/utils"
+)
+
+// Upload the content read from r to the given path using SFTP. As the SFTP
+// subsystem runs with the permissions of the login user, the content is
+// written to a temporary file first, that is moved into place using sudo (if
+// the user isn't root).
+func (target *sshTarget) Upload(r io.Reader, path string, opts *UploadOptions) (e error) {
+	if target.client == nil {
+		if target.client, e = target.buildClient(); e != nil {
+			return e
+		}
+	}
+	if target.sftp == nil {
+		if target.sftp, e = sftp.NewClient(target.client); e != nil {
+			return e
+		}
+	}
+
+	src, e := tmpPathFor("/tmp/upload")
+	if e != nil {
+		return e
+	}
+	// the file must not be readable by others before its mode is set
+	f, e := target.sftp.OpenFile(src, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if e != nil {
+		return e
+	}
+	moved := false
+	defer func() {
+		if !moved {
+			target.sftp.Remove(src)
+		}
+	}()
+	if e = f.Chmod(0600); e != nil {
+		f.Close()
+		return e
+	}
+	if _, e = io.Copy(f, r); e != nil {
+		f.Close()
+		return e
+	}
+	if e = f.Close(); e != nil {
+		return e
+	}
+
+	rawCmd, e := finalizeUploadCmd(src, path, opts)
+	if e != nil {
+		return e
+	}
+	if target.user != "root" {
+		rawCmd = "sudo sh -c " + utils.ShellQuote(rawCmd)
+	}
+	c, e := target.Command(rawCmd)
+	if e != nil {
+		return e
+	}
+	stderr := &bytes.Buffer{}
+	c.SetStderr(stderr)
+	if e = c.Run(); e != nil {
+		return fmt.Errorf("failed to move uploaded file to %q: %s (%s)", path, e, stderr.String())
+	}
+	moved = true
+	return nil
+}
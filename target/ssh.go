@@ -8,6 +8,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 )
@@ -53,7 +54,13 @@ func NewSshTarget(addr string) (target *sshTarget, e error) {
 }
 
 type sshTarget struct {
-	Password string
+	Password     string
+	ForwardAgent bool // Forward the local SSH agent (see SSH_AUTH_SOCK) into all sessions.
+	Pty          *Pty // Allocate a pseudo terminal with these settings for all build commands (except those reading stdin).
+
+	// Bastion host all connections are tunneled through (like ssh's
+	// ProxyJump). It is connected to with its own user and credentials.
+	Bastion *sshTarget
 
 	user    string
 	port    int
@@ -61,7 +68,10 @@ type sshTarget struct {
 
 	key []byte
 
-	client *ssh.Client
+	client         *ssh.Client
+	sftp           *sftp.Client
+	agentForwarded bool // Whether the client already forwards agent channels.
+	agentRequested bool // Whether a session of the client was granted agent forwarding.
 }
 
 func (target *sshTarget) User() string {
@@ -84,21 +94,56 @@ func (target *sshTarget) Command(cmd string) (ExecCommand, error) {
 	if e != nil {
 		return nil, e
 	}
-	return &sshCommand{command: cmd, session: ses}, nil
+	c := &sshCommand{command: cmd, session: ses, target: target}
+	if target.ForwardAgent {
+		if e := c.ForwardAgent(); e != nil {
+			ses.Close()
+			return nil, e
+		}
+	}
+	return c, nil
 }
 
 func (target *sshTarget) Reset() (e error) {
+	if target.sftp != nil {
+		target.sftp.Close()
+		target.sftp = nil
+	}
 	if target.client != nil {
 		e = target.client.Close()
 		target.client = nil
+		target.agentForwarded = false
+		target.agentRequested = false
+	}
+	if target.Bastion != nil {
+		if err := target.Bastion.Reset(); e == nil {
+			e = err
+		}
 	}
 	return e
 }
 
+// Make the client forward agent channels opened by the remote host to the
+// local agent. This is done only once per client.
+func (target *sshTarget) forwardAgentChannels() error {
+	if target.agentForwarded {
+		return nil
+	}
+	sshSocket := os.Getenv("SSH_AUTH_SOCK")
+	if sshSocket == "" {
+		return fmt.Errorf("agent forwarding requested, but SSH_AUTH_SOCK is not set")
+	}
+	if e := agent.ForwardToRemote(target.client, sshSocket); e != nil {
+		return e
+	}
+	target.agentForwarded = true
+	return nil
+}
+
 func (target *sshTarget) buildClient() (*ssh.Client, error) {
-	var e error
 	config := &ssh.ClientConfig{
-		User: target.user,
+		User:            target.user,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 	}
 
 	signers := []ssh.Signer{}
@@ -125,16 +170,95 @@ func (target *sshTarget) buildClient() (*ssh.Client, error) {
 		config.Auth = append(config.Auth, ssh.PublicKeys(signers...))
 	}
 
-	con, e := ssh.Dial("tcp", fmt.Sprintf("%s:%d", target.address, target.port), config)
+	addr := fmt.Sprintf("%s:%d", target.address, target.port)
+	if target.Bastion == nil {
+		return ssh.Dial("tcp", addr, config)
+	}
+
+	if target.Bastion.client == nil {
+		c, e := target.Bastion.buildClient()
+		if e != nil {
+			return nil, fmt.Errorf("failed to connect to bastion %s: %s", target.Bastion, e)
+		}
+		target.Bastion.client = c
+	}
+	conn, e := target.Bastion.client.Dial("tcp", addr)
+	if e != nil {
+		return nil, fmt.Errorf("failed to tunnel to %s via bastion %s: %s", addr, target.Bastion, e)
+	}
+	c, chans, reqs, e := ssh.NewClientConn(conn, addr, config)
 	if e != nil {
+		conn.Close()
 		return nil, e
 	}
-	return &ssh.Client{Conn: con}, nil
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// Settings of a pseudo terminal allocated for a session. Note that with a PTY
+// the remote command's stderr is merged into stdout, i.e. everything arrives on
+// the stdout stream. Output isn't post-processed (no CR is added to newlines),
+// so data streamed by the command arrives unaltered.
+type Pty struct {
+	Term   string // Terminal type (TERM), "xterm" if empty.
+	Width  int    // Width in characters, 80 if not set.
+	Height int    // Height in characters, 40 if not set.
 }
 
 type sshCommand struct {
 	command string
 	session *ssh.Session
+	target  *sshTarget
+
+	agentRequested bool // Whether agent forwarding was requested for the session.
+}
+
+// Forward the local SSH agent into the command's session. The remote command
+// will find the agent's socket in SSH_AUTH_SOCK. Must be called before the
+// command is started; calling it again is a no-op.
+func (c *sshCommand) ForwardAgent() error {
+	if c.agentRequested {
+		return nil
+	}
+	if e := c.target.forwardAgentChannels(); e != nil {
+		return e
+	}
+	c.agentRequested = true
+	e := agent.RequestAgentForwarding(c.session)
+	switch {
+	case e == nil:
+		c.target.agentRequested = true
+	case c.target.agentRequested:
+		// OpenSSH grants agent forwarding only once per connection and refuses
+		// later requests, but all sessions of the connection share the agent
+		// socket (and the client forwards its channels already).
+		return nil
+	}
+	return e
+}
+
+// Allocate a pseudo terminal for the command's session, using the target's
+// PTY settings if given. Must be called before the command is started.
+func (c *sshCommand) RequestPty() error {
+	pty := &Pty{}
+	if c.target.Pty != nil {
+		*pty = *c.target.Pty
+	}
+	if pty.Term == "" {
+		pty.Term = "xterm"
+	}
+	if pty.Width == 0 {
+		pty.Width = 80
+	}
+	if pty.Height == 0 {
+		pty.Height = 40
+	}
+	modes := ssh.TerminalModes{ssh.ECHO: 0, ssh.OPOST: 0, ssh.TTY_OP_ISPEED: 14400, ssh.TTY_OP_OSPEED: 14400}
+	return c.session.RequestPty(pty.Term, pty.Height, pty.Width, modes)
+}
+
+// Whether the target was configured to allocate a PTY for all build commands.
+func (c *sshCommand) PtyEnabled() bool {
+	return c.target.Pty != nil
 }
 
 func (c *sshCommand) Close() error {
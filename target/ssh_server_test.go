@@ -0,0 +1,321 @@
+package target_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dynport/urknall/target"
+	"github.com/dynport/urknall/urknalltest"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func startServer(t *testing.T) *urknalltest.SSHServer {
+	srv, err := urknalltest.NewSSHServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Password = "secret"
+	return srv
+}
+
+func generateKey(t *testing.T) (ed25519.PrivateKey, ssh.PublicKey, []byte) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, signer.PublicKey(), pem.EncodeToMemory(block)
+}
+
+func run(t *testing.T, tgt interface {
+	Command(string) (target.ExecCommand, error)
+}, cmd string) (string, error) {
+	c, err := tgt.Command(cmd)
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	out := &bytes.Buffer{}
+	c.SetStdout(out)
+	err = c.Run()
+	return out.String(), err
+}
+
+func TestSshTargetPasswordAuth(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Close()
+
+	tgt, err := target.NewSshTarget("root@" + srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tgt.Reset()
+
+	tgt.Password = "wrong"
+	if _, err := tgt.Command("true"); err == nil {
+		t.Errorf("expected authentication with wrong password to fail")
+	}
+
+	tgt.Password = "secret"
+	if out, err := run(t, tgt, "echo hello"); err != nil {
+		t.Errorf("didn't expect an error, got %q", err)
+	} else if out != "hello\n" {
+		t.Errorf("expected output to be %q, was %q", "hello\n", out)
+	}
+
+	_, err = run(t, tgt, "exit 3")
+	if ee, ok := err.(*ssh.ExitError); !ok || ee.ExitStatus() != 3 {
+		t.Errorf("expected exit status %d, got %v", 3, err)
+	}
+}
+
+func TestSshTargetKeyAuth(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Close()
+	_, pub, key := generateKey(t)
+	srv.Authorize(pub)
+
+	tgt, err := target.NewSshTargetWithPrivateKey("root@"+srv.Addr(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tgt.Reset()
+	if out, err := run(t, tgt, "echo key"); err != nil {
+		t.Errorf("didn't expect an error, got %q", err)
+	} else if out != "key\n" {
+		t.Errorf("expected output to be %q, was %q", "key\n", out)
+	}
+}
+
+func TestSshTargetAgentAuthAndForwarding(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Close()
+	priv, pub, _ := generateKey(t)
+	srv.Authorize(pub)
+
+	a, err := urknalltest.StartAgent(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	os.Setenv("SSH_AUTH_SOCK", a.Path)
+
+	tgt, err := target.NewSshTarget("root@" + srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tgt.Reset()
+	tgt.ForwardAgent = true
+
+	c, err := tgt.Command(`echo "$SSH_AUTH_SOCK"; read done`)
+	if err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	stdout, err := c.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	sock, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock = strings.TrimSpace(sock)
+	if sock == "" || sock == a.Path {
+		t.Fatalf("expected a forwarded agent socket, got %q", sock)
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := agent.NewClient(conn).List()
+	conn.Close()
+	if err != nil {
+		t.Fatalf("didn't expect an error listing forwarded keys, got %q", err)
+	}
+	if len(keys) != 1 || !bytes.Equal(keys[0].Blob, pub.Marshal()) {
+		t.Errorf("expected the forwarded agent to provide the local key, got %v", keys)
+	}
+	stdin.Write([]byte("done\n"))
+	stdin.Close()
+	if err := c.Wait(); err != nil {
+		t.Errorf("didn't expect an error, got %q", err)
+	}
+}
+
+func TestSshTargetAgentForwardingOnReusedConnection(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Close()
+	priv, pub, _ := generateKey(t)
+	srv.Authorize(pub)
+
+	a, err := urknalltest.StartAgent(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	os.Setenv("SSH_AUTH_SOCK", a.Path)
+
+	tgt, err := target.NewSshTarget("root@" + srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tgt.Reset()
+	tgt.ForwardAgent = true
+
+	for i := 0; i < 2; i++ {
+		c, err := tgt.Command(`test -S "$SSH_AUTH_SOCK"`)
+		if err != nil {
+			t.Fatalf("%d: didn't expect an error, got %q", i, err)
+		}
+		// a second request for the same session (as done for commands
+		// requiring agent forwarding) must not be sent
+		if err := c.(target.AgentForwarder).ForwardAgent(); err != nil {
+			t.Fatalf("%d: didn't expect an error, got %q", i, err)
+		}
+		if err := c.Run(); err != nil {
+			t.Errorf("%d: expected the agent's socket to be available, got %q", i, err)
+		}
+		if v, ex := srv.AgentRequests(), i+1; v != ex {
+			t.Errorf("%d: expected %d agent forwarding requests, got %d", i, ex, v)
+		}
+	}
+}
+
+func TestSshTargetStdinAndPty(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Close()
+	tgt, err := target.NewSshTarget("root@" + srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tgt.Reset()
+	tgt.Password = "secret"
+
+	c, err := tgt.Command("cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.(target.PtyRequester).RequestPty(); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	out := &bytes.Buffer{}
+	c.SetStdout(out)
+	c.SetStdin(strings.NewReader("piped content"))
+	if err := c.Run(); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := out.String(), "piped content"; v != ex {
+		t.Errorf("expected output to be %q, was %q", ex, v)
+	}
+	if v := srv.PtyRequests(); v != 1 {
+		t.Errorf("expected %d PTY request, got %d", 1, v)
+	}
+}
+
+func TestSshTargetBastion(t *testing.T) {
+	bastionSrv := startServer(t)
+	defer bastionSrv.Close()
+	srv := startServer(t)
+	defer srv.Close()
+	_, pub, key := generateKey(t)
+	srv.Authorize(pub)
+
+	tgt, err := target.NewSshTargetWithPrivateKey("root@"+srv.Addr(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tgt.Reset()
+	tgt.Bastion, err = target.NewSshTarget("jump@" + bastionSrv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tgt.Bastion.Password = "secret"
+
+	if out, err := run(t, tgt, "echo tunneled"); err != nil {
+		t.Errorf("didn't expect an error, got %q", err)
+	} else if out != "tunneled\n" {
+		t.Errorf("expected output to be %q, was %q", "tunneled\n", out)
+	}
+	if v := bastionSrv.Tunnels(); v != 1 {
+		t.Errorf("expected %d tunnel through the bastion, got %d", 1, v)
+	}
+
+	tgt.Bastion.Password = "wrong"
+	tgt.Reset()
+	if _, err := tgt.Command("true"); err == nil || !strings.Contains(err.Error(), "bastion") {
+		t.Errorf("expected connecting via bastion with wrong credentials to fail, got %v", err)
+	}
+}
+
+func TestSshTargetUpload(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("uploads as non root user require sudo")
+	}
+	srv := startServer(t)
+	defer srv.Close()
+	tgt, err := target.NewSshTarget("root@" + srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tgt.Reset()
+	tgt.Password = "secret"
+
+	dir, err := ioutil.TempDir("", "urknall-sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "conf", "app.conf")
+	if err := tgt.Upload(strings.NewReader("uploaded"), path, &target.UploadOptions{Mode: 0640}); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ex := string(b), "uploaded"; v != ex {
+		t.Errorf("expected content to be %q, was %q", ex, v)
+	}
+	if fi, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if v, ex := fi.Mode().Perm(), os.FileMode(0640); v != ex {
+		t.Errorf("expected mode to be %o, was %o", ex, v)
+	}
+
+	before, _ := filepath.Glob("/tmp/.upload.urknall.*")
+	err = tgt.Upload(strings.NewReader("failed"), path, &target.UploadOptions{Owner: "urknall-no-such-user"})
+	if err == nil {
+		t.Fatalf("expected an error for an unknown owner, got none")
+	}
+	if after, _ := filepath.Glob("/tmp/.upload.urknall.*"); len(after) != len(before) {
+		t.Errorf("expected the temporary file to be removed, found %v", after)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != "uploaded" {
+		t.Errorf("expected failed upload to keep the file, content was %q", b)
+	}
+}
@@ -0,0 +1,74 @@
+package target
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dynport/urknall/utils"
+)
+
+// Options for files uploaded to a target.
+type UploadOptions struct {
+	Mode  os.FileMode // Permissions of the file (0644 if not set).
+	Owner string      // Owner of the file (root if empty).
+	Group string      // Group of the file (the owner's login group if empty).
+}
+
+// Targets that can transfer files directly, i.e. without encoding the content
+// into a command, implement the Uploader interface. The content is streamed
+// into a temporary file, that is renamed to the given path once complete.
+// Thereby the file at the path is replaced atomically.
+type Uploader interface {
+	Upload(r io.Reader, path string, opts *UploadOptions) error
+}
+
+func (opts *UploadOptions) mode() os.FileMode {
+	if opts == nil || opts.Mode == 0 {
+		return 0644
+	}
+	return opts.Mode
+}
+
+// Ownership is always set, as the uploaded file belongs to the login user
+// otherwise.
+func (opts *UploadOptions) chownArg() string {
+	owner, group := "root", ""
+	if opts != nil && opts.Owner != "" {
+		owner = opts.Owner
+	}
+	if opts != nil {
+		group = opts.Group
+	}
+	return owner + ":" + group
+}
+
+// Name of a temporary file next to the given path, used for atomic renames.
+func tmpPathFor(path string) (string, error) {
+	b := make([]byte, 8)
+	if _, e := rand.Read(b); e != nil {
+		return "", e
+	}
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".urknall."+hex.EncodeToString(b)), nil
+}
+
+// Command that moves the uploaded file at src to the path given, setting mode
+// and ownership before the final (atomic) rename.
+func finalizeUploadCmd(src, path string, opts *UploadOptions) (string, error) {
+	tmp, e := tmpPathFor(path)
+	if e != nil {
+		return "", e
+	}
+	cmds := []string{
+		"mkdir -p " + utils.ShellQuote(filepath.Dir(path)),
+		"mv " + utils.ShellQuote(src) + " " + utils.ShellQuote(tmp),
+		fmt.Sprintf("chmod %o %s", opts.mode(), utils.ShellQuote(tmp)),
+		"chown " + utils.ShellQuote(opts.chownArg()) + " " + utils.ShellQuote(tmp),
+	}
+	cmds = append(cmds, "mv -f "+utils.ShellQuote(tmp)+" "+utils.ShellQuote(path))
+	return strings.Join(cmds, " && "), nil
+}
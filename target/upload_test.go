@@ -0,0 +1,80 @@
+package target
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalUpload(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("local uploads require root (or sudo)")
+	}
+	dir, err := ioutil.TempDir("", "urknall-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "etc", "app.conf")
+	tgt := NewLocalTarget()
+	if err := tgt.Upload(strings.NewReader("hello world"), path, &UploadOptions{Mode: 0600}); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ex := string(b), "hello world"; v != ex {
+		t.Errorf("expected content to be %q, was %q", ex, v)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ex := fi.Mode().Perm(), os.FileMode(0600); v != ex {
+		t.Errorf("expected mode to be %o, was %o", ex, v)
+	}
+
+	// replace existing file, no temporary files must be left behind
+	if err := tgt.Upload(strings.NewReader("updated"), path, nil); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	files, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("expected 1 file in directory, found %d", len(files))
+	}
+	if fi, err = os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if v, ex := fi.Mode().Perm(), os.FileMode(0644); v != ex {
+		t.Errorf("expected mode to be %o, was %o", ex, v)
+	}
+}
+
+func TestFinalizeUploadCmd(t *testing.T) {
+	c, err := finalizeUploadCmd("/tmp/src", "/etc/it's.conf", &UploadOptions{Mode: 0640, Owner: "app", Group: "adm"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ex := range []string{"mkdir -p '/etc'", "chmod 640 ", "chown 'app:adm' ", `'/etc/it'"'"'s.conf'`} {
+		if !strings.Contains(c, ex) {
+			t.Errorf("expected %q to contain %q", c, ex)
+		}
+	}
+	if !strings.HasSuffix(c, `'/etc/it'"'"'s.conf'`) {
+		t.Errorf("expected %q to end with the move to the destination", c)
+	}
+
+	if c, err = finalizeUploadCmd("/tmp/src", "/etc/app.conf", nil); err != nil {
+		t.Fatal(err)
+	}
+	if ex := "chown 'root:' "; !strings.Contains(c, ex) {
+		t.Errorf("expected %q to contain %q", c, ex)
+	}
+}
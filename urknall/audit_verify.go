@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dynport/urknall"
+)
+
+type auditVerify struct {
+	Path string `cli:"arg required desc='path of the audit log'"`
+}
+
+func (v *auditVerify) Run() error {
+	f, e := os.Open(v.Path)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+
+	cnt, e := urknall.VerifyAuditLog(f)
+	if e != nil {
+		return fmt.Errorf("audit log %s is invalid after %d entries: %s", v.Path, cnt, e)
+	}
+	fmt.Printf("audit log %s is valid (%d entries)\n", v.Path, cnt)
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dynport/urknall"
+)
+
+type gc struct {
+	KeepRuns int    `cli:"opt -n --keep-runs desc='number of runs (executed commands) kept per task'"`
+	MaxAge   string `cli:"opt -a --max-age desc='runs newer than this are kept (like 720h)'"`
+
+	Address string `cli:"arg required desc='address of the host of the form [<user>@]<host>[:<port>]'"`
+}
+
+func (g *gc) Run() error {
+	r := &urknall.Retention{KeepRuns: g.KeepRuns}
+	if g.MaxAge != "" {
+		d, e := time.ParseDuration(g.MaxAge)
+		if e != nil {
+			return fmt.Errorf("invalid max age %q: %s", g.MaxAge, e)
+		}
+		r.MaxAge = d
+	}
+	if r.KeepRuns <= 0 && r.MaxAge <= 0 {
+		return fmt.Errorf("either the number of runs to keep or the max age must be given")
+	}
+
+	t, e := urknall.NewSshTarget(g.Address)
+	if e != nil {
+		return e
+	}
+	removed, e := urknall.GC(t, r)
+	if e != nil {
+		return e
+	}
+	for _, entry := range removed {
+		fmt.Println("removed " + entry)
+	}
+	fmt.Printf("removed %d entries from %s\n", len(removed), t)
+	return nil
+}
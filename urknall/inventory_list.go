@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dynport/urknall/inventory"
+)
+
+type inventoryList struct {
+	File     string `cli:"opt -f --file default=inventory.json desc='path of the inventory'"`
+	Exec     string `cli:"opt -e --exec desc='executable printing the inventory as JSON (used instead of the file)'"`
+	CacheTTL string `cli:"opt --cache-ttl desc='duration the output of the executable is cached for (like 10m)'"`
+
+	Names []string `cli:"arg desc='hosts or groups to list (all if empty)'"`
+}
+
+func (l *inventoryList) Run() error {
+	var src inventory.Source = inventory.FileSource(l.File)
+	if l.Exec != "" {
+		fields := strings.Fields(l.Exec)
+		src = &inventory.ExecSource{Path: fields[0], Args: fields[1:]}
+		if l.CacheTTL != "" {
+			ttl, e := time.ParseDuration(l.CacheTTL)
+			if e != nil {
+				return fmt.Errorf("invalid cache TTL %q: %s", l.CacheTTL, e)
+			}
+			dir, e := os.UserCacheDir()
+			if e != nil {
+				return e
+			}
+			name := fmt.Sprintf("inventory-%x.json", sha256.Sum256([]byte(l.Exec)))
+			src = inventory.Cached(src, filepath.Join(dir, "urknall", name), ttl)
+		}
+	}
+	i, e := src.Inventory()
+	if e != nil {
+		return e
+	}
+	hosts, e := i.Select(l.Names...)
+	if e != nil {
+		return e
+	}
+	for _, h := range hosts {
+		line := h.Name + " " + h.SshAddress()
+		if h.Bastion != "" {
+			line += " via " + h.Bastion
+		}
+		if len(h.Groups) > 0 {
+			line += " [" + strings.Join(h.Groups, ", ") + "]"
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
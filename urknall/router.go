@@ -7,5 +7,10 @@ func router() *cli.Router {
 	router.Register("init", &initProject{}, "Initialize a basic urknall project.")
 	router.Register("templates/add", &templatesAdd{}, "Add templates to project.")
 	router.Register("templates/list", &templatesList{}, "List all available templates.")
+	router.Register("audit/verify", &auditVerify{}, "Verify the hash chain of an audit log.")
+	router.Register("gc", &gc{}, "Remove old build history from a host.")
+	router.Register("force-unlock", &forceUnlock{}, "Remove a build lock left on a host.")
+	router.Register("inventory/list", &inventoryList{}, "List the hosts of an inventory.")
+	router.Register("schema", &schema{}, "Print the JSON Schema of specs for the templates of a project (its main package must support the -schema flag).")
 	return router
 }
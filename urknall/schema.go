@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+type schema struct {
+	Dir string `cli:"opt -d --dir default=. desc='directory of the project (its main package must support the -schema flag)'"`
+	Out string `cli:"opt -o --out desc='file the schema is written to (stdout if empty)'"`
+}
+
+// The templates are only known to the project's binary, hence it is run with
+// the -schema flag (see the main.go created by init).
+func (s *schema) Run() error {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	c := exec.Command("go", "run", ".", "-schema")
+	c.Dir = s.Dir
+	c.Stdout = stdout
+	c.Stderr = stderr
+	if e := c.Run(); e != nil {
+		return fmt.Errorf("failed to run project in %s (its main package must support the -schema flag, printing urknall.SpecSchema): %s\n%s", s.Dir, e, stderr.String())
+	}
+
+	// validate and indent the output
+	var v interface{}
+	if e := json.Unmarshal(stdout.Bytes(), &v); e != nil {
+		return fmt.Errorf("project in %s printed no valid schema (its main package must support the -schema flag, printing urknall.SpecSchema): %s", s.Dir, e)
+	}
+	b, e := json.MarshalIndent(v, "", "  ")
+	if e != nil {
+		return e
+	}
+	b = append(b, '\n')
+	if s.Out == "" {
+		_, e = os.Stdout.Write(b)
+		return e
+	}
+	return ioutil.WriteFile(s.Out, b, 0644)
+}
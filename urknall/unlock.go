@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dynport/urknall"
+)
+
+type forceUnlock struct {
+	Address string `cli:"arg required desc='address of the host of the form [<user>@]<host>[:<port>]'"`
+}
+
+func (f *forceUnlock) Run() error {
+	t, e := urknall.NewSshTarget(f.Address)
+	if e != nil {
+		return e
+	}
+	if e := urknall.ForceUnlock(t); e != nil {
+		return e
+	}
+	fmt.Printf("removed build lock from %s\n", t)
+	return nil
+}
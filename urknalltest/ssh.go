@@ -0,0 +1,419 @@
+package urknalltest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// An in-process SSH server for end-to-end tests of targets and builds. The
+// server listens on localhost and executes commands locally using "bash -c"
+// (as the user running the tests). Password and public key authentication
+// (including keys served by an agent) are supported, as well as agent
+// forwarding, the sftp subsystem and TCP tunnels (so the server can act as
+// bastion). Requests for pseudo terminals are acknowledged (and counted), but
+// no terminal is allocated. Like OpenSSH, agent forwarding is granted once per
+// connection, and all later sessions of the connection get the agent's socket.
+type SSHServer struct {
+	Password string // Password accepted (password authentication is disabled if empty).
+	StateDir string // Directory used to simulate /var/lib/urknall in commands (not rewritten if empty). The host is considered prepared then.
+
+	listener      net.Listener
+	mutex         sync.Mutex
+	keys          []ssh.PublicKey
+	ptys          int
+	agentRequests int
+	tunnels       int
+	wg            sync.WaitGroup
+}
+
+// State of a client connection.
+type serverConn struct {
+	*ssh.ServerConn
+	mutex      sync.Mutex
+	agentSock  string // socket forwarded to the client's agent (if requested)
+	closeAgent func()
+}
+
+// Start a new server listening on a random port on localhost.
+func NewSSHServer() (*SSHServer, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &SSHServer{listener: l}
+	config := &ssh.ServerConfig{
+		PasswordCallback:  s.checkPassword,
+		PublicKeyCallback: s.checkPublicKey,
+	}
+	config.AddHostKey(hostKey)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleConn(c, config)
+		}
+	}()
+	return s, nil
+}
+
+// Address the server listens on (of the form "127.0.0.1:<port>").
+func (s *SSHServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Accept the given public key for authentication.
+func (s *SSHServer) Authorize(key ssh.PublicKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys = append(s.keys, key)
+}
+
+// Number of pseudo terminals requested by clients.
+func (s *SSHServer) PtyRequests() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.ptys
+}
+
+// Number of agent forwarding requests received (including refused ones).
+func (s *SSHServer) AgentRequests() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.agentRequests
+}
+
+// Number of TCP tunnels opened by clients.
+func (s *SSHServer) Tunnels() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.tunnels
+}
+
+// Stop listening for new connections.
+func (s *SSHServer) Close() error {
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *SSHServer) checkPassword(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	if s.Password != "" && string(password) == s.Password {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("password rejected for %q", c.User())
+}
+
+func (s *SSHServer) checkPublicKey(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, k := range s.keys {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("public key rejected for %q", c.User())
+}
+
+func (s *SSHServer) handleConn(c net.Conn, config *ssh.ServerConfig) {
+	conn, chans, reqs, err := ssh.NewServerConn(c, config)
+	if err != nil {
+		c.Close()
+		return
+	}
+	defer conn.Close()
+	sc := &serverConn{ServerConn: conn}
+	defer func() {
+		sc.mutex.Lock()
+		defer sc.mutex.Unlock()
+		if sc.closeAgent != nil {
+			sc.closeAgent()
+		}
+	}()
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		switch nc.ChannelType() {
+		case "session":
+			ch, reqs, err := nc.Accept()
+			if err != nil {
+				continue
+			}
+			go s.handleSession(sc, ch, reqs)
+		case "direct-tcpip":
+			go s.handleTunnel(nc)
+		default:
+			nc.Reject(ssh.UnknownChannelType, "only sessions and tunnels are supported")
+		}
+	}
+}
+
+func (s *SSHServer) handleTunnel(nc ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(nc.ExtraData(), &payload); err != nil {
+		nc.Reject(ssh.ConnectionFailed, "invalid payload")
+		return
+	}
+	c, err := net.Dial("tcp", net.JoinHostPort(payload.Host, fmt.Sprint(payload.Port)))
+	if err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer c.Close()
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+	s.mutex.Lock()
+	s.tunnels++
+	s.mutex.Unlock()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(ch, c)
+		ch.CloseWrite()
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(c, ch)
+		if tc, ok := c.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+// Forward the client's agent, unless it was forwarded already.
+func (sc *serverConn) forwardAgent() bool {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if sc.agentSock != "" {
+		return false
+	}
+	path, closer, err := forwardAgent(sc.ServerConn)
+	if err != nil {
+		return false
+	}
+	sc.agentSock, sc.closeAgent = path, closer
+	return true
+}
+
+func (sc *serverConn) agentEnv() []string {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if sc.agentSock == "" {
+		return nil
+	}
+	return []string{"SSH_AUTH_SOCK=" + sc.agentSock}
+}
+
+func (s *SSHServer) handleSession(conn *serverConn, ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	env := []string{}
+	for req := range reqs {
+		switch req.Type {
+		case "pty-req":
+			s.mutex.Lock()
+			s.ptys++
+			s.mutex.Unlock()
+			req.Reply(true, nil)
+		case "env":
+			var kv struct{ Key, Value string }
+			if err := ssh.Unmarshal(req.Payload, &kv); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			env = append(env, kv.Key+"="+kv.Value)
+			req.Reply(true, nil)
+		case "auth-agent-req@openssh.com":
+			s.mutex.Lock()
+			s.agentRequests++
+			s.mutex.Unlock()
+			req.Reply(conn.forwardAgent(), nil)
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(reqs)
+			cmd := payload.Command
+			var status uint32
+			switch {
+			case s.StateDir != "" && strings.Contains(cmd, "/etc/group"):
+				// the host is always prepared for provisioning
+				if err := os.MkdirAll(s.StateDir, 0755); err != nil {
+					status = 1
+				}
+			case s.StateDir != "":
+				status = execute(ch, strings.Replace(cmd, stateDir, s.StateDir, -1), append(env, conn.agentEnv()...))
+			default:
+				status = execute(ch, cmd, append(env, conn.agentEnv()...))
+			}
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+		case "subsystem":
+			var payload struct{ Name string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil || payload.Name != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(reqs)
+			if server, err := sftp.NewServer(ch); err == nil {
+				server.Serve()
+			}
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func execute(ch ssh.Channel, command string, env []string) uint32 {
+	cmd := exec.Command("bash", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = ch
+	cmd.Stderr = ch.Stderr()
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return 255
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintln(ch.Stderr(), err)
+		return 127
+	}
+	go func() {
+		io.Copy(in, ch)
+		in.Close()
+	}()
+	err = cmd.Wait()
+	if ee, ok := err.(*exec.ExitError); ok {
+		return uint32(ee.ExitCode())
+	} else if err != nil {
+		return 255
+	}
+	return 0
+}
+
+// Serve a socket, whose connections are forwarded to the client's agent.
+func forwardAgent(conn *ssh.ServerConn) (path string, closer func(), err error) {
+	dir, err := ioutil.TempDir("", "urknalltest-agent")
+	if err != nil {
+		return "", nil, err
+	}
+	path = filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				ch, reqs, err := conn.OpenChannel("auth-agent@openssh.com", nil)
+				if err != nil {
+					return
+				}
+				defer ch.Close()
+				go ssh.DiscardRequests(reqs)
+				go func() {
+					io.Copy(ch, c)
+					ch.CloseWrite()
+				}()
+				io.Copy(c, ch)
+			}()
+		}
+	}()
+	return path, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}, nil
+}
+
+// An SSH agent for tests. Set SSH_AUTH_SOCK to its Path to use it.
+type Agent struct {
+	Path     string
+	dir      string
+	listener net.Listener
+}
+
+// Start an agent serving the given private keys (see agent.AddedKey for the
+// supported types) on a socket in a temporary directory.
+func StartAgent(keys ...interface{}) (*Agent, error) {
+	keyring := agent.NewKeyring()
+	for _, k := range keys {
+		if err := keyring.Add(agent.AddedKey{PrivateKey: k}); err != nil {
+			return nil, err
+		}
+	}
+	dir, err := ioutil.TempDir("", "urknalltest-agent")
+	if err != nil {
+		return nil, err
+	}
+	a := &Agent{Path: filepath.Join(dir, "agent.sock"), dir: dir}
+	if a.listener, err = net.Listen("unix", a.Path); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	go func() {
+		for {
+			c, err := a.listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				agent.ServeAgent(keyring, c)
+			}()
+		}
+	}()
+	return a, nil
+}
+
+// Stop the agent and remove its socket.
+func (a *Agent) Close() error {
+	err := a.listener.Close()
+	os.RemoveAll(a.dir)
+	return err
+}
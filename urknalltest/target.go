@@ -0,0 +1,384 @@
+// Package urknalltest provides utilities for testing templates.
+//
+// The fake Target records every command it receives and answers them
+// according to the responses registered using the Handle method. The state
+// urknall keeps on the host (in /var/lib/urknall) is simulated in a temporary
+// directory, i.e. the internal commands managing the state are executed
+// locally (with the paths rewritten), while the commands of the templates are
+// never executed. Thereby caching, partial failures and retries of builds can
+// be tested without a host.
+package urknalltest
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dynport/urknall/target"
+
+	"github.com/dynport/urknall/utils"
+)
+
+const stateDir = "/var/lib/urknall"
+
+// Shim for sudo, that drops options and applies environment settings.
+const sudoShim = `#!/bin/sh
+while [ $# -gt 0 ]; do
+	case "$1" in
+		-*) shift;;
+		*=*) export "$1"; shift;;
+		*) break;;
+	esac
+done
+exec "$@"
+`
+
+var (
+	cachedCommandRegexp = regexp.MustCompile(`(?s)tee \$dir/[0-9a-f]+\.sh > /dev/null <<"UKEOF"\n(.*)\nUKEOF\n`)
+	executionRegexp     = regexp.MustCompile(`bash \$dir/[0-9a-f]+\.sh `)
+)
+
+// The response of the fake target to a command.
+type Response struct {
+	Stdout     string
+	Stderr     string
+	ExitStatus int
+}
+
+type handler struct {
+	pattern  *regexp.Regexp
+	response *Response
+}
+
+// A fake target. Use NewTarget to create one and make sure to close it
+// afterwards.
+type Target struct {
+	Name  string // Name of the target ("FAKE" if empty).
+	Login string // User commands are executed as ("root" if empty).
+
+	dir      string
+	mutex    sync.Mutex
+	handlers []*handler
+	commands []string
+	executed []string
+}
+
+// Create a new fake target with empty state.
+func NewTarget() (*Target, error) {
+	dir, err := ioutil.TempDir("", "urknalltest")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "bin"), 0755); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "bin", "sudo"), []byte(sudoShim), 0755); err != nil {
+		return nil, err
+	}
+	return &Target{dir: dir}, nil
+}
+
+// Remove the simulated state.
+func (t *Target) Close() error {
+	return os.RemoveAll(t.dir)
+}
+
+// Register the response for commands matching the given regular expression.
+// For the commands of templates the pattern is matched against the command's
+// shell code, otherwise against the raw command sent to the target. Handlers
+// registered later take precedence. Commands without a matching handler
+// succeed without output.
+func (t *Target) Handle(pattern string, r *Response) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.handlers = append(t.handlers, &handler{pattern: regexp.MustCompile(pattern), response: r})
+}
+
+// All raw commands sent to the target.
+func (t *Target) Commands() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]string{}, t.commands...)
+}
+
+// The shell code of the template commands executed.
+func (t *Target) Executed() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]string{}, t.executed...)
+}
+
+// Directory used to simulate /var/lib/urknall.
+func (t *Target) StateDir() string {
+	return filepath.Join(t.dir, "state")
+}
+
+// The checksums of the last run of each task, as listed in the simulated state.
+func (t *Target) State() (map[string][]string, error) {
+	state := map[string][]string{}
+	dirs, err := ioutil.ReadDir(t.StateDir())
+	switch {
+	case os.IsNotExist(err):
+		return state, nil
+	case err != nil:
+		return nil, err
+	}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		files, err := filepath.Glob(filepath.Join(t.StateDir(), d.Name(), "*.run"))
+		if err != nil {
+			return nil, err
+		}
+		last, err := newestFile(files)
+		switch {
+		case err != nil:
+			return nil, err
+		case last == "":
+			continue
+		}
+		b, err := ioutil.ReadFile(last)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range strings.Fields(string(b)) {
+			state[d.Name()] = append(state[d.Name()], strings.TrimSuffix(filepath.Base(l), ".done"))
+		}
+	}
+	return state, nil
+}
+
+func newestFile(files []string) (string, error) {
+	sort.Strings(files)
+	newest := ""
+	var newestInfo os.FileInfo
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return "", err
+		}
+		if newestInfo == nil || !fi.ModTime().Before(newestInfo.ModTime()) {
+			newest, newestInfo = f, fi
+		}
+	}
+	return newest, nil
+}
+
+func (t *Target) String() string {
+	if t.Name == "" {
+		return "FAKE"
+	}
+	return t.Name
+}
+
+func (t *Target) User() string {
+	if t.Login == "" {
+		return "root"
+	}
+	return t.Login
+}
+
+func (t *Target) Reset() error {
+	return nil
+}
+
+func (t *Target) Command(cmd string) (target.ExecCommand, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.commands = append(t.commands, cmd)
+	return &command{target: t, raw: cmd}, nil
+}
+
+func (t *Target) response(cmd string) *Response {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for i := len(t.handlers) - 1; i >= 0; i-- {
+		if t.handlers[i].pattern.MatchString(cmd) {
+			return t.handlers[i].response
+		}
+	}
+	return nil
+}
+
+// Returns the script to run locally for the given command, or the response to
+// be sent.
+func (t *Target) prepare(cmd string) (script string, r *Response, err error) {
+	if m := cachedCommandRegexp.FindStringSubmatch(cmd); m != nil {
+		r = t.response(m[1])
+		if r == nil {
+			r = &Response{}
+		}
+		if !executionRegexp.MatchString(cmd) {
+			return t.rewrite(cmd), nil, nil
+		}
+		t.mutex.Lock()
+		t.executed = append(t.executed, m[1])
+		t.mutex.Unlock()
+
+		stub, err := ioutil.TempFile(t.dir, "stub")
+		if err != nil {
+			return "", nil, err
+		}
+		defer stub.Close()
+		_, err = fmt.Fprintf(stub, "printf '%%s' %s\nprintf '%%s' %s >&2\nexit %d\n",
+			utils.ShellQuote(r.Stdout), utils.ShellQuote(r.Stderr), r.ExitStatus)
+		if err != nil {
+			return "", nil, err
+		}
+		return t.rewrite(executionRegexp.ReplaceAllString(cmd, "bash "+stub.Name()+" ")), nil, nil
+	}
+	if r := t.response(cmd); r != nil {
+		return "", r, nil
+	}
+	switch {
+	case strings.Contains(cmd, "/etc/group"):
+		// the host is always prepared for provisioning
+		if err := os.MkdirAll(t.StateDir(), 0755); err != nil {
+			return "", nil, err
+		}
+		return "", &Response{}, nil
+	case strings.Contains(cmd, stateDir):
+		return t.rewrite(cmd), nil, nil
+	}
+	return "", &Response{}, nil
+}
+
+func (t *Target) rewrite(cmd string) string {
+	return strings.Replace(cmd, stateDir, t.StateDir(), -1)
+}
+
+// Error returned for commands with a non zero exit status.
+type ExitError struct {
+	Status int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Status)
+}
+
+func (e *ExitError) ExitStatus() int {
+	return e.Status
+}
+
+type command struct {
+	target *Target
+	raw    string
+
+	stdout, stderr io.Writer
+	stdin          io.Reader
+	closers        []io.Closer
+
+	done chan struct{}
+	err  error
+}
+
+func (c *command) StdoutPipe() (io.Reader, error) {
+	r, w := io.Pipe()
+	c.stdout = w
+	c.closers = append(c.closers, w)
+	return r, nil
+}
+
+func (c *command) StderrPipe() (io.Reader, error) {
+	r, w := io.Pipe()
+	c.stderr = w
+	c.closers = append(c.closers, w)
+	return r, nil
+}
+
+func (c *command) StdinPipe() (io.WriteCloser, error) {
+	r, w := io.Pipe()
+	c.stdin = r
+	return w, nil
+}
+
+func (c *command) SetStdout(w io.Writer) {
+	c.stdout = w
+}
+
+func (c *command) SetStderr(w io.Writer) {
+	c.stderr = w
+}
+
+func (c *command) SetStdin(r io.Reader) {
+	c.stdin = r
+}
+
+func (c *command) Run() error {
+	if err := c.Start(); err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+func (c *command) Start() error {
+	if c.done != nil {
+		return fmt.Errorf("command already started")
+	}
+	if c.stdout == nil {
+		c.stdout = ioutil.Discard
+	}
+	if c.stderr == nil {
+		c.stderr = ioutil.Discard
+	}
+	script, r, err := c.target.prepare(c.raw)
+	if err != nil {
+		return err
+	}
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		defer func() {
+			for _, cl := range c.closers {
+				cl.Close()
+			}
+		}()
+		if r != nil {
+			c.err = c.respond(r)
+		} else {
+			c.err = c.execute(script)
+		}
+	}()
+	return nil
+}
+
+func (c *command) respond(r *Response) error {
+	if c.stdin != nil {
+		io.Copy(ioutil.Discard, c.stdin)
+	}
+	io.WriteString(c.stdout, r.Stdout)
+	io.WriteString(c.stderr, r.Stderr)
+	if r.ExitStatus != 0 {
+		return &ExitError{Status: r.ExitStatus}
+	}
+	return nil
+}
+
+func (c *command) execute(script string) error {
+	cmd := exec.Command("bash", "-c", script)
+	cmd.Env = append(os.Environ(), "PATH="+filepath.Join(c.target.dir, "bin")+":"+os.Getenv("PATH"))
+	cmd.Stdout = c.stdout
+	cmd.Stderr = c.stderr
+	cmd.Stdin = c.stdin
+	err := cmd.Run()
+	if ee, ok := err.(*exec.ExitError); ok {
+		return &ExitError{Status: ee.ExitCode()}
+	}
+	return err
+}
+
+func (c *command) Wait() error {
+	if c.done == nil {
+		return fmt.Errorf("command not started")
+	}
+	<-c.done
+	return c.err
+}
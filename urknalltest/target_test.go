@@ -0,0 +1,43 @@
+package urknalltest
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTargetHandle(t *testing.T) {
+	ft, err := NewTarget()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ft.Close()
+
+	ft.Handle("^uname", &Response{Stdout: "Linux\n"})
+	ft.Handle("^false$", &Response{Stderr: "failed\n", ExitStatus: 2})
+
+	c, err := ft.Command("uname -s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	c.SetStdout(out)
+	if err := c.Run(); err != nil {
+		t.Fatalf("didn't expect an error, got %q", err)
+	}
+	if v, ex := out.String(), "Linux\n"; v != ex {
+		t.Errorf("expected stdout to be %q, was %q", ex, v)
+	}
+
+	c, err = ft.Command("false")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Run()
+	if ee, ok := err.(*ExitError); !ok || ee.ExitStatus() != 2 {
+		t.Errorf("expected exit status %d, got %v", 2, err)
+	}
+
+	if v := ft.Commands(); len(v) != 2 || v[0] != "uname -s" || v[1] != "false" {
+		t.Errorf("expected commands to be recorded, got %q", v)
+	}
+}
@@ -5,10 +5,19 @@ import (
 	"fmt"
 
 	"github.com/dynport/urknall/cmd"
+	"github.com/dynport/urknall/target"
 )
 
 func renderTemplate(builder Template) (*packageImpl, error) {
-	p := &packageImpl{reference: builder}
+	return renderTemplateWithFacts(builder, nil)
+}
+
+// Render the template with the given host facts available to it (and all
+// nested templates). Templates are shared by the concurrent builds of a
+// rollout, hence a copy of each is rendered (see withFacts).
+func renderTemplateWithFacts(builder Template, facts *Facts) (*packageImpl, error) {
+	builder = withFacts(builder, facts)
+	p := &packageImpl{reference: builder, facts: facts}
 	e := validateTemplate(builder)
 	if e != nil {
 		return nil, e
@@ -42,3 +51,45 @@ func midTrunc(in string, l int) string {
 	}
 	return in[0:beg] + "..." + in[len(in)-end:]
 }
+
+// Returns the exit status of commands that failed with a non zero exit status.
+func exitStatus(err error) (int, bool) {
+	switch e := err.(type) {
+	case interface {
+		ExitStatus() int
+	}:
+		return e.ExitStatus(), true
+	case interface {
+		ExitCode() int
+	}:
+		return e.ExitCode(), true
+	}
+	return 0, false
+}
+
+// Returns the given wrapper of the exec command c, extended by the optional
+// interfaces (agent forwarding and PTYs) implemented by c. Thereby wrappers
+// don't hide features of the target's commands.
+func withOptionalInterfaces(wrapper, c target.ExecCommand) target.ExecCommand {
+	af, isAF := c.(target.AgentForwarder)
+	pr, isPR := c.(target.PtyRequester)
+	switch {
+	case isAF && isPR:
+		return &struct {
+			target.ExecCommand
+			target.AgentForwarder
+			target.PtyRequester
+		}{wrapper, af, pr}
+	case isAF:
+		return &struct {
+			target.ExecCommand
+			target.AgentForwarder
+		}{wrapper, af}
+	case isPR:
+		return &struct {
+			target.ExecCommand
+			target.PtyRequester
+		}{wrapper, pr}
+	}
+	return wrapper
+}
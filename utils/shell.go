@@ -0,0 +1,8 @@
+package utils
+
+import "strings"
+
+// Quote the given string for use as a single word in shell commands.
+func ShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}